@@ -0,0 +1,126 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+
+	"github.com/jay-dee7/MailHog-Server/mimetree"
+	"github.com/labstack/echo/v4"
+	"github.com/mailhog/data"
+)
+
+type mimePart struct {
+	Path        string      `json:"path"`
+	ContentType string      `json:"contentType"`
+	Filename    string      `json:"filename,omitempty"`
+	Disposition string      `json:"disposition,omitempty"`
+	ContentID   string      `json:"contentId,omitempty"`
+	Size        int         `json:"size"`
+	SHA256      string      `json:"sha256,omitempty"`
+	Parts       []*mimePart `json:"parts,omitempty"`
+}
+
+func newMIMEPart(p *mimetree.Part) *mimePart {
+	mp := &mimePart{
+		Path:        p.ID(),
+		ContentType: p.ContentType,
+		Filename:    p.Filename(),
+		Disposition: p.Disposition(),
+		ContentID:   p.ContentID(),
+		Size:        len(p.Body),
+	}
+
+	if p.IsMultipart() {
+		for _, c := range p.Parts {
+			mp.Parts = append(mp.Parts, newMIMEPart(c))
+		}
+		return mp
+	}
+
+	if b, err := p.Decode(); err == nil {
+		sum := sha256.Sum256(b)
+		mp.Size = len(b)
+		mp.SHA256 = hex.EncodeToString(sum[:])
+	}
+	return mp
+}
+
+func (v2 *APIv2) mime(ctx echo.Context) error {
+	id := ctx.Param("id")
+	tenant, ok := ctx.Get("tenant").(string)
+	if !ok {
+		return ctx.JSON(http.StatusPreconditionRequired, echo.Map{
+			"error": "missing tenant id in request context",
+		})
+	}
+
+	message, err := v2.config.Storage.Load(id, tenant)
+	if err != nil {
+		return ctx.JSON(http.StatusNotFound, ErrorResp{Error: err.Error()})
+	}
+
+	tree, err := mimetree.Parse(mimetree.Raw(message))
+	if err != nil {
+		return ctx.JSON(http.StatusInternalServerError, ErrorResp{Error: err.Error()})
+	}
+
+	return ctx.JSON(http.StatusOK, newMIMEPart(tree))
+}
+
+// hasAttachment returns true if the message has an attachment whose file name
+// contains query or whose content type starts with query
+func hasAttachment(message *data.Message, query string) bool {
+	tree, err := mimetree.Parse(mimetree.Raw(message))
+	if err != nil {
+		return false
+	}
+
+	query = strings.ToLower(query)
+	found := false
+	tree.Walk(func(p *mimetree.Part) {
+		if found || !p.IsAttachment() {
+			return
+		}
+		found = strings.Contains(strings.ToLower(p.Filename()), query) ||
+			strings.HasPrefix(p.ContentType, query)
+	})
+	return found
+}
+
+// searchAttachments implements the "attachment" search kind, which the
+// storage backends can't evaluate themselves
+func (v2 *APIv2) searchAttachments(query string, start, limit int, tenant string) (*data.Messages, int, error) {
+	return v2.filterMessages(start, limit, tenant, func(m *data.Message) bool {
+		return hasAttachment(m, query)
+	})
+}
+
+// filterMessages pages through every stored message of the tenant and
+// returns the matches between start and start+limit along with the
+// total number of matches
+func (v2 *APIv2) filterMessages(start, limit int, tenant string, match func(m *data.Message) bool) (*data.Messages, int, error) {
+	const pageSize = 250
+
+	result := data.Messages{}
+	total := 0
+	for offset := 0; ; offset += pageSize {
+		page, err := v2.config.Storage.List(offset, pageSize, tenant)
+		if err != nil {
+			return nil, 0, err
+		}
+		for i := range *page {
+			if !match(&(*page)[i]) {
+				continue
+			}
+			if total >= start && len(result) < limit {
+				result = append(result, (*page)[i])
+			}
+			total++
+		}
+		if len(*page) < pageSize {
+			return &result, total, nil
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/mailhog/data"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const attachmentMessage = "From: a@mailhog.example\r\n" +
+	"Subject: Report\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/mixed; boundary=\"b1\"\r\n" +
+	"\r\n" +
+	"--b1\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"See the attached report.\r\n" +
+	"--b1\r\n" +
+	"Content-Type: application/pdf\r\n" +
+	"Content-Disposition: attachment; filename=\"Q3-Report.pdf\"\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"JVBERi0xLjQK\r\n" +
+	"--b1--\r\n"
+
+func TestHasAttachment(t *testing.T) {
+	tests := []struct {
+		query string
+		found bool
+	}{
+		{"report", true},
+		{"Q3-REPORT.PDF", true},
+		{".pdf", true},
+		{"application/", true},
+		{"application/pdf", true},
+		{"text/plain", false},
+		{"invoice", false},
+	}
+
+	message := &data.Message{Raw: &data.SMTPMessage{Data: attachmentMessage}}
+	for _, test := range tests {
+		Convey("hasAttachment should match "+test.query, t, func() {
+			So(hasAttachment(message, test.query), ShouldEqual, test.found)
+		})
+	}
+
+	Convey("hasAttachment should ignore messages without attachments", t, func() {
+		plain := &data.Message{Raw: &data.SMTPMessage{Data: "Subject: Hi\r\n\r\nSee report.pdf\r\n"}}
+		So(hasAttachment(plain, "report"), ShouldBeFalse)
+	})
+}
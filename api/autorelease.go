@@ -0,0 +1,63 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/jay-dee7/MailHog-Server/release"
+	"github.com/labstack/echo/v4"
+)
+
+func (v2 *APIv2) listAutoReleaseRules(ctx echo.Context) error {
+	tenant, ok := ctx.Get("tenant").(string)
+	if !ok {
+		return ctx.JSON(http.StatusPreconditionRequired, echo.Map{
+			"error": "missing tenant id in request context",
+		})
+	}
+
+	return ctx.JSON(http.StatusOK, v2.config.AutoReleases.List(tenant))
+}
+
+func (v2 *APIv2) putAutoReleaseRule(ctx echo.Context) error {
+	tenant, ok := ctx.Get("tenant").(string)
+	if !ok {
+		return ctx.JSON(http.StatusPreconditionRequired, echo.Map{
+			"error": "missing tenant id in request context",
+		})
+	}
+
+	var rule release.Rule
+	if err := json.NewDecoder(ctx.Request().Body).Decode(&rule); err != nil {
+		return ctx.JSON(http.StatusBadRequest, ErrorResp{Error: err.Error()})
+	}
+	rule.Name = ctx.Param("name")
+
+	if _, ok := v2.config.OutgoingServers.Get(tenant, rule.Server); !ok {
+		return ctx.JSON(http.StatusBadRequest, ErrorResp{Error: release.ErrServerNotFound.Error()})
+	}
+	if err := v2.config.AutoReleases.Put(tenant, rule); err != nil {
+		return ctx.JSON(http.StatusBadRequest, ErrorResp{Error: err.Error()})
+	}
+
+	return ctx.JSON(http.StatusOK, rule)
+}
+
+func (v2 *APIv2) deleteAutoReleaseRule(ctx echo.Context) error {
+	tenant, ok := ctx.Get("tenant").(string)
+	if !ok {
+		return ctx.JSON(http.StatusPreconditionRequired, echo.Map{
+			"error": "missing tenant id in request context",
+		})
+	}
+
+	err := v2.config.AutoReleases.Delete(tenant, ctx.Param("name"))
+	switch {
+	case err == release.ErrRuleNotFound:
+		return ctx.JSON(http.StatusNotFound, ErrorResp{Error: err.Error()})
+	case err != nil:
+		return ctx.JSON(http.StatusInternalServerError, ErrorResp{Error: err.Error()})
+	}
+
+	return ctx.JSON(http.StatusOK, nil)
+}
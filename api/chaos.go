@@ -0,0 +1,52 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+func (v2 *APIv2) getJim(ctx echo.Context) error {
+	tenant, ok := ctx.Get("tenant").(string)
+	if !ok {
+		return ctx.JSON(http.StatusPreconditionRequired, echo.Map{
+			"error": "missing tenant id in request context",
+		})
+	}
+
+	return ctx.JSON(http.StatusOK, v2.config.Chaos.Get(tenant))
+}
+
+// putJim changes the settings of the tenant, fields which are omitted keep
+// their current values
+func (v2 *APIv2) putJim(ctx echo.Context) error {
+	tenant, ok := ctx.Get("tenant").(string)
+	if !ok {
+		return ctx.JSON(http.StatusPreconditionRequired, echo.Map{
+			"error": "missing tenant id in request context",
+		})
+	}
+
+	settings := v2.config.Chaos.Get(tenant)
+	if err := json.NewDecoder(ctx.Request().Body).Decode(&settings); err != nil {
+		return ctx.JSON(http.StatusBadRequest, ErrorResp{Error: err.Error()})
+	}
+	if err := v2.config.Chaos.Put(tenant, settings); err != nil {
+		return ctx.JSON(http.StatusBadRequest, ErrorResp{Error: err.Error()})
+	}
+
+	return ctx.JSON(http.StatusOK, v2.config.Chaos.Get(tenant))
+}
+
+func (v2 *APIv2) resetJim(ctx echo.Context) error {
+	tenant, ok := ctx.Get("tenant").(string)
+	if !ok {
+		return ctx.JSON(http.StatusPreconditionRequired, echo.Map{
+			"error": "missing tenant id in request context",
+		})
+	}
+
+	v2.config.Chaos.Reset(tenant)
+	return ctx.JSON(http.StatusOK, v2.config.Chaos.Get(tenant))
+}
@@ -0,0 +1,197 @@
+package api
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jay-dee7/MailHog-Server/codes"
+	"github.com/jay-dee7/MailHog-Server/mimetree"
+	"github.com/labstack/echo/v4"
+	"github.com/mailhog/data"
+	"golang.org/x/net/html"
+)
+
+// maxWait limits how long a request may wait for a message to arrive
+const maxWait = 5 * time.Minute
+
+// waitInterval is how often storage is polled while waiting for a message
+const waitInterval = 500 * time.Millisecond
+
+type codesResult struct {
+	ID      string              `json:"id"`
+	Rule    string              `json:"rule"`
+	Created time.Time           `json:"created"`
+	Values  []map[string]string `json:"values"`
+}
+
+// messageText returns the decoded subject and text content of a message,
+// with HTML parts reduced to their text
+func messageText(tree *mimetree.Part) string {
+	subject, err := new(mime.WordDecoder).DecodeHeader(tree.Header.Get("Subject"))
+	if err != nil {
+		subject = tree.Header.Get("Subject")
+	}
+
+	texts := []string{subject}
+	tree.Walk(func(p *mimetree.Part) {
+		if !p.IsText() || p.Disposition() == "attachment" {
+			return
+		}
+		text, err := p.Text()
+		if err != nil {
+			return
+		}
+		if p.ContentType == "text/html" {
+			doc, err := html.Parse(strings.NewReader(text))
+			if err != nil {
+				return
+			}
+			text = nodeText(doc)
+		}
+		texts = append(texts, text)
+	})
+	return strings.Join(texts, "\n")
+}
+
+// latestMessage returns the most recent message matching the search, or
+// nil if there is none. An empty query matches every message.
+func (v2 *APIv2) latestMessage(kind, query, tenant string) (*data.Message, error) {
+	var messages *data.Messages
+	var err error
+	if len(query) > 0 {
+		messages, _, err = v2.searchMessages(kind, query, 0, 1, tenant)
+	} else {
+		messages, err = v2.config.Storage.List(0, 1, tenant)
+	}
+	if err != nil || len(*messages) == 0 {
+		return nil, err
+	}
+	return &(*messages)[0], nil
+}
+
+// waitParams parses the wait and since query params shared by the
+// endpoints which can wait for a message to arrive
+func waitParams(ctx echo.Context) (deadline, since time.Time, err error) {
+	deadline = time.Now()
+	if w := ctx.QueryParam("wait"); len(w) > 0 {
+		d, err := time.ParseDuration(w)
+		if err != nil {
+			return deadline, since, err
+		}
+		if d > maxWait {
+			d = maxWait
+		}
+		deadline = deadline.Add(d)
+	}
+	if s := ctx.QueryParam("since"); len(s) > 0 {
+		if since, err = time.Parse(time.RFC3339, s); err != nil {
+			return deadline, since, err
+		}
+	}
+	return deadline, since, nil
+}
+
+func (v2 *APIv2) codes(ctx echo.Context) error {
+	tenant, ok := ctx.Get("tenant").(string)
+	if !ok {
+		return ctx.JSON(http.StatusPreconditionRequired, echo.Map{
+			"error": "missing tenant id in request context",
+		})
+	}
+
+	name := ctx.QueryParam("rule")
+	if len(name) == 0 {
+		name = "numeric"
+	}
+	rule, ok := v2.codeRules.Get(tenant, name)
+	if !ok {
+		return ctx.JSON(http.StatusBadRequest, ErrorResp{Error: "unknown rule: " + name})
+	}
+
+	deadline, since, err := waitParams(ctx)
+	if err != nil {
+		return ctx.JSON(http.StatusBadRequest, ErrorResp{Error: err.Error()})
+	}
+
+	kind, query := ctx.QueryParam("kind"), ctx.QueryParam("query")
+	for {
+		message, err := v2.latestMessage(kind, query, tenant)
+		if err != nil {
+			return ctx.JSON(http.StatusInternalServerError, ErrorResp{Error: err.Error()})
+		}
+
+		if message != nil && message.Created.After(since) {
+			if tree, err := mimetree.Parse(mimetree.Raw(message)); err == nil {
+				if values := rule.Extract(messageText(tree)); len(values) > 0 {
+					return ctx.JSON(http.StatusOK, codesResult{
+						ID:      string(message.ID),
+						Rule:    rule.Name,
+						Created: message.Created,
+						Values:  values,
+					})
+				}
+			}
+		}
+
+		if time.Now().After(deadline) {
+			return ctx.JSON(http.StatusNotFound, ErrorResp{Error: "no matching message with a code"})
+		}
+
+		select {
+		case <-ctx.Request().Context().Done():
+			return nil
+		case <-time.After(waitInterval):
+		}
+	}
+}
+
+func (v2 *APIv2) listCodeRules(ctx echo.Context) error {
+	tenant, ok := ctx.Get("tenant").(string)
+	if !ok {
+		return ctx.JSON(http.StatusPreconditionRequired, echo.Map{
+			"error": "missing tenant id in request context",
+		})
+	}
+
+	return ctx.JSON(http.StatusOK, v2.codeRules.List(tenant))
+}
+
+func (v2 *APIv2) putCodeRule(ctx echo.Context) error {
+	tenant, ok := ctx.Get("tenant").(string)
+	if !ok {
+		return ctx.JSON(http.StatusPreconditionRequired, echo.Map{
+			"error": "missing tenant id in request context",
+		})
+	}
+
+	var req codes.Rule
+	if err := json.NewDecoder(ctx.Request().Body).Decode(&req); err != nil {
+		return ctx.JSON(http.StatusBadRequest, ErrorResp{Error: err.Error()})
+	}
+
+	rule, err := codes.NewRule(ctx.Param("name"), req.Pattern)
+	if err != nil {
+		return ctx.JSON(http.StatusBadRequest, ErrorResp{Error: err.Error()})
+	}
+	v2.codeRules.Set(tenant, rule)
+
+	return ctx.JSON(http.StatusOK, rule)
+}
+
+func (v2 *APIv2) deleteCodeRule(ctx echo.Context) error {
+	tenant, ok := ctx.Get("tenant").(string)
+	if !ok {
+		return ctx.JSON(http.StatusPreconditionRequired, echo.Map{
+			"error": "missing tenant id in request context",
+		})
+	}
+
+	if !v2.codeRules.Delete(tenant, ctx.Param("name")) {
+		return ctx.JSON(http.StatusNotFound, ErrorResp{Error: "rule not found"})
+	}
+
+	return ctx.JSON(http.StatusOK, nil)
+}
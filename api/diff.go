@@ -0,0 +1,66 @@
+package api
+
+import (
+	"net/http"
+	"regexp"
+
+	"github.com/jay-dee7/MailHog-Server/msgdiff"
+	"github.com/labstack/echo/v4"
+)
+
+// diffResult is the comparison of two messages
+type diffResult struct {
+	A string `json:"a"`
+	B string `json:"b"`
+	msgdiff.Result
+}
+
+// diff compares the message a with the message b. Volatile fields are
+// normalized unless normalize=false, and text matching any ignore
+// parameter is ignored either way.
+func (v2 *APIv2) diff(ctx echo.Context) error {
+	a, b := ctx.QueryParam("a"), ctx.QueryParam("b")
+	tenant, ok := ctx.Get("tenant").(string)
+	if !ok {
+		return ctx.JSON(http.StatusPreconditionRequired, echo.Map{
+			"error": "missing tenant id in request context",
+		})
+	}
+
+	if len(a) == 0 || len(b) == 0 {
+		return ctx.JSON(http.StatusBadRequest, ErrorResp{Error: "a and b message ids are required"})
+	}
+
+	var ignore []*regexp.Regexp
+	for _, expr := range ctx.QueryParams()["ignore"] {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return ctx.JSON(http.StatusBadRequest, ErrorResp{Error: err.Error()})
+		}
+		ignore = append(ignore, re)
+	}
+
+	var renditions []*msgdiff.Rendition
+	for _, id := range []string{a, b} {
+		msg, err := v2.config.Storage.Load(id, tenant)
+		if err != nil {
+			return ctx.JSON(http.StatusNotFound, ErrorResp{Error: err.Error()})
+		}
+		r, err := msgdiff.Render(msg)
+		if err != nil {
+			return ctx.JSON(http.StatusUnprocessableEntity, ErrorResp{Error: err.Error()})
+		}
+		if ctx.QueryParam("normalize") != "false" {
+			r.Normalize(ignore)
+		} else {
+			r.Ignore(ignore)
+		}
+		renditions = append(renditions, r)
+	}
+
+	return ctx.JSON(http.StatusOK, diffResult{
+		A:      a,
+		B:      b,
+		Result: msgdiff.Compare(renditions[0], renditions[1]),
+	})
+}
@@ -0,0 +1,36 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+func (v2 *APIv2) listGreylist(ctx echo.Context) error {
+	tenant, ok := ctx.Get("tenant").(string)
+	if !ok {
+		return ctx.JSON(http.StatusPreconditionRequired, echo.Map{
+			"error": "missing tenant id in request context",
+		})
+	}
+
+	if v2.config.Greylist == nil {
+		return ctx.JSON(http.StatusNotFound, ErrorResp{Error: "greylisting is disabled"})
+	}
+	return ctx.JSON(http.StatusOK, v2.config.Greylist.List(tenant))
+}
+
+func (v2 *APIv2) resetGreylist(ctx echo.Context) error {
+	tenant, ok := ctx.Get("tenant").(string)
+	if !ok {
+		return ctx.JSON(http.StatusPreconditionRequired, echo.Map{
+			"error": "missing tenant id in request context",
+		})
+	}
+
+	if v2.config.Greylist == nil {
+		return ctx.JSON(http.StatusNotFound, ErrorResp{Error: "greylisting is disabled"})
+	}
+	v2.config.Greylist.Reset(tenant)
+	return ctx.JSON(http.StatusOK, nil)
+}
@@ -0,0 +1,211 @@
+package api
+
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/jay-dee7/MailHog-Server/mimetree"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/net/html"
+)
+
+var textURLRegexp = regexp.MustCompile(`https?://[^\s<>"']+`)
+var pixelSizeRegexp = regexp.MustCompile(`(?i)(width|height)\s*:\s*([0-9]+)px`)
+
+type link struct {
+	URL  string `json:"url"`
+	Text string `json:"text,omitempty"`
+	Part string `json:"part"`
+}
+
+type unsubscribeTarget struct {
+	URL      string `json:"url"`
+	OneClick bool   `json:"oneClick"`
+}
+
+type linksResult struct {
+	Links       []link              `json:"links"`
+	Pixels      []link              `json:"pixels"`
+	Unsubscribe []unsubscribeTarget `json:"unsubscribe"`
+}
+
+func (r *linksResult) addLink(l link) {
+	for _, e := range r.Links {
+		if e == l {
+			return
+		}
+	}
+	r.Links = append(r.Links, l)
+}
+
+// nodeText returns the whitespace normalised text content of a node
+func nodeText(n *html.Node) string {
+	var b strings.Builder
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		switch {
+		case n.Type == html.TextNode:
+			b.WriteString(n.Data)
+			b.WriteString(" ")
+		case n.Type == html.ElementNode && n.Data == "img":
+			for _, a := range n.Attr {
+				if a.Key == "alt" {
+					b.WriteString(a.Val)
+					b.WriteString(" ")
+				}
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(n)
+	return strings.Join(strings.Fields(b.String()), " ")
+}
+
+// isTrackingPixel returns true for images which are sized at most 1x1 pixel
+// or hidden, the usual shape of open tracking beacons
+func isTrackingPixel(n *html.Node) bool {
+	sizes := map[string]int{}
+	for _, a := range n.Attr {
+		switch strings.ToLower(a.Key) {
+		case "width", "height":
+			if v, err := strconv.Atoi(strings.TrimSuffix(strings.TrimSpace(a.Val), "px")); err == nil {
+				sizes[strings.ToLower(a.Key)] = v
+			}
+		case "style":
+			style := strings.ToLower(strings.Replace(a.Val, " ", "", -1))
+			if strings.Contains(style, "display:none") || strings.Contains(style, "visibility:hidden") {
+				return true
+			}
+			for _, m := range pixelSizeRegexp.FindAllStringSubmatch(a.Val, -1) {
+				v, _ := strconv.Atoi(m[2])
+				sizes[strings.ToLower(m[1])] = v
+			}
+		}
+	}
+	w, hasW := sizes["width"]
+	h, hasH := sizes["height"]
+	return hasW && hasH && w <= 1 && h <= 1
+}
+
+func extractHTMLLinks(r *linksResult, p *mimetree.Part, text string) error {
+	doc, err := html.Parse(strings.NewReader(text))
+	if err != nil {
+		return err
+	}
+
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			switch n.Data {
+			case "a", "area":
+				for _, a := range n.Attr {
+					if a.Key == "href" && len(strings.TrimSpace(a.Val)) > 0 {
+						r.addLink(link{URL: strings.TrimSpace(a.Val), Text: nodeText(n), Part: p.ID()})
+					}
+				}
+			case "img":
+				if isTrackingPixel(n) {
+					for _, a := range n.Attr {
+						if a.Key == "src" {
+							r.Pixels = append(r.Pixels, link{URL: strings.TrimSpace(a.Val), Part: p.ID()})
+						}
+					}
+				}
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+	return nil
+}
+
+func extractTextLinks(r *linksResult, p *mimetree.Part, text string) {
+	for _, u := range textURLRegexp.FindAllString(text, -1) {
+		r.addLink(link{URL: strings.TrimRight(u, ".,;:!?)]}>"), Part: p.ID()})
+	}
+}
+
+// extractUnsubscribe parses the List-Unsubscribe header (RFC 2369) and
+// its one-click companion (RFC 8058)
+func extractUnsubscribe(r *linksResult, tree *mimetree.Part) {
+	oneClick := strings.Contains(strings.ToLower(tree.Header.Get("List-Unsubscribe-Post")), "list-unsubscribe=one-click")
+	for _, h := range tree.Header["List-Unsubscribe"] {
+		for _, s := range strings.Split(h, ",") {
+			s = strings.TrimSpace(s)
+			if !strings.HasPrefix(s, "<") || !strings.HasSuffix(s, ">") {
+				continue
+			}
+			u := strings.TrimSpace(s[1 : len(s)-1])
+			r.Unsubscribe = append(r.Unsubscribe, unsubscribeTarget{
+				URL:      u,
+				OneClick: oneClick && strings.HasPrefix(strings.ToLower(u), "https:"),
+			})
+		}
+	}
+}
+
+// extractLinks returns the hyperlinks, tracking pixels and unsubscribe
+// targets of a message
+func extractLinks(tree *mimetree.Part) (*linksResult, error) {
+	r := &linksResult{
+		Links:       []link{},
+		Pixels:      []link{},
+		Unsubscribe: []unsubscribeTarget{},
+	}
+
+	var err error
+	tree.Walk(func(p *mimetree.Part) {
+		if err != nil || !p.IsText() || p.Disposition() == "attachment" {
+			return
+		}
+		var text string
+		if text, err = p.Text(); err != nil {
+			return
+		}
+		switch p.ContentType {
+		case "text/html":
+			err = extractHTMLLinks(r, p, text)
+		case "text/plain":
+			extractTextLinks(r, p, text)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	extractUnsubscribe(r, tree)
+	return r, nil
+}
+
+func (v2 *APIv2) links(ctx echo.Context) error {
+	id := ctx.Param("id")
+	tenant, ok := ctx.Get("tenant").(string)
+	if !ok {
+		return ctx.JSON(http.StatusPreconditionRequired, echo.Map{
+			"error": "missing tenant id in request context",
+		})
+	}
+
+	message, err := v2.config.Storage.Load(id, tenant)
+	if err != nil {
+		return ctx.JSON(http.StatusNotFound, ErrorResp{Error: err.Error()})
+	}
+
+	tree, err := mimetree.Parse(mimetree.Raw(message))
+	if err != nil {
+		return ctx.JSON(http.StatusInternalServerError, ErrorResp{Error: err.Error()})
+	}
+
+	res, err := extractLinks(tree)
+	if err != nil {
+		return ctx.JSON(http.StatusInternalServerError, ErrorResp{Error: err.Error()})
+	}
+
+	return ctx.JSON(http.StatusOK, res)
+}
@@ -0,0 +1,60 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/jay-dee7/MailHog-Server/mimetree"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestExtractLinks(t *testing.T) {
+	tests := []struct {
+		name   string
+		raw    string
+		result linksResult
+	}{
+		{
+			name: "text links",
+			raw:  "Subject: Hi\r\n\r\nConfirm at https://app.example/confirm?t=1. Or (https://app.example/help).\r\n",
+			result: linksResult{
+				Links:       []link{{URL: "https://app.example/confirm?t=1", Part: "0"}, {URL: "https://app.example/help", Part: "0"}},
+				Pixels:      []link{},
+				Unsubscribe: []unsubscribeTarget{},
+			},
+		},
+		{
+			name: "html links and pixels",
+			raw: "Subject: Hi\r\nContent-Type: text/html\r\n\r\n" +
+				`<a href=" https://app.example/a ">Open <b>app</b></a><a href="https://app.example/a">Open <b>app</b></a>` +
+				`<a href="https://app.example/b"><img alt="Logo" src="logo.png"></a>` +
+				`<img src="https://t.example/o.gif" width="1" height="1"><img src="https://t.example/h.gif" style="display: none">` +
+				`<img src="https://app.example/banner.png" width="600" height="1">` + "\r\n",
+			result: linksResult{
+				Links:       []link{{URL: "https://app.example/a", Text: "Open app", Part: "0"}, {URL: "https://app.example/b", Text: "Logo", Part: "0"}},
+				Pixels:      []link{{URL: "https://t.example/o.gif", Part: "0"}, {URL: "https://t.example/h.gif", Part: "0"}},
+				Unsubscribe: []unsubscribeTarget{},
+			},
+		},
+		{
+			name: "unsubscribe targets",
+			raw: "Subject: Hi\r\n" +
+				"List-Unsubscribe: <mailto:unsub@app.example>, <https://app.example/unsub>\r\n" +
+				"List-Unsubscribe-Post: List-Unsubscribe=One-Click\r\n\r\nHi.\r\n",
+			result: linksResult{
+				Links:       []link{},
+				Pixels:      []link{},
+				Unsubscribe: []unsubscribeTarget{{URL: "mailto:unsub@app.example"}, {URL: "https://app.example/unsub", OneClick: true}},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		Convey("extractLinks should return "+test.name, t, func() {
+			tree, err := mimetree.Parse([]byte(test.raw))
+			So(err, ShouldBeNil)
+			r, err := extractLinks(tree)
+			So(err, ShouldBeNil)
+			So(*r, ShouldResemble, test.result)
+		})
+	}
+}
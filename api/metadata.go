@@ -0,0 +1,176 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/jay-dee7/MailHog-Server/metadata"
+	"github.com/labstack/echo/v4"
+	"github.com/mailhog/data"
+)
+
+// messageItem is a message along with its metadata
+type messageItem struct {
+	data.Message
+	metadata.Meta
+}
+
+func (v2 *APIv2) withMeta(tenant string, messages *data.Messages) []messageItem {
+	items := make([]messageItem, 0, len(*messages))
+	for _, m := range *messages {
+		items = append(items, messageItem{m, v2.config.Metadata.Get(tenant, string(m.ID))})
+	}
+	return items
+}
+
+// qualifier splits a search query such as tag:urgent into its kind and
+// query, if it starts with a metadata qualifier
+func qualifier(query string) (kind, q string, ok bool) {
+	parts := strings.SplitN(query, ":", 2)
+	if len(parts) != 2 {
+		return "", "", false
+	}
+	switch parts[0] {
+	case "tag", "label", "is":
+		return parts[0], parts[1], true
+	}
+	return "", "", false
+}
+
+// matchMeta returns a function matching the metadata for a search:
+// tag:name, label:key, label:key=value, is:starred or is:read
+func matchMeta(kind, query string) func(metadata.Meta) bool {
+	switch kind {
+	case "tag":
+		return func(m metadata.Meta) bool {
+			for _, t := range m.Tags {
+				if strings.EqualFold(t, query) {
+					return true
+				}
+			}
+			return false
+		}
+	case "label":
+		kv := strings.SplitN(query, "=", 2)
+		return func(m metadata.Meta) bool {
+			v, ok := m.Labels[kv[0]]
+			return ok && (len(kv) == 1 || v == kv[1])
+		}
+	case "is":
+		return func(m metadata.Meta) bool {
+			return (query == "starred" && m.Starred) || (query == "read" && m.Read)
+		}
+	}
+	return func(metadata.Meta) bool { return false }
+}
+
+func (v2 *APIv2) searchMeta(kind, query string, start, limit int, tenant string) (*data.Messages, int, error) {
+	// unread messages are those without the read flag, including those
+	// without any metadata
+	if kind == "is" && query == "unread" {
+		read := v2.config.Metadata.Find(tenant, matchMeta(kind, "read"))
+		return v2.filterMessages(start, limit, tenant, func(m *data.Message) bool {
+			return !read[string(m.ID)]
+		})
+	}
+
+	ids := v2.config.Metadata.Find(tenant, matchMeta(kind, query))
+	if len(ids) == 0 {
+		return &data.Messages{}, 0, nil
+	}
+	return v2.filterMessages(start, limit, tenant, func(m *data.Message) bool {
+		return ids[string(m.ID)]
+	})
+}
+
+func (v2 *APIv2) getMeta(ctx echo.Context) error {
+	tenant, ok := ctx.Get("tenant").(string)
+	if !ok {
+		return ctx.JSON(http.StatusPreconditionRequired, echo.Map{
+			"error": "missing tenant id in request context",
+		})
+	}
+
+	return ctx.JSON(http.StatusOK, v2.config.Metadata.Get(tenant, ctx.Param("id")))
+}
+
+func (v2 *APIv2) updateMeta(ctx echo.Context) error {
+	id := ctx.Param("id")
+	tenant, ok := ctx.Get("tenant").(string)
+	if !ok {
+		return ctx.JSON(http.StatusPreconditionRequired, echo.Map{
+			"error": "missing tenant id in request context",
+		})
+	}
+
+	if _, err := v2.config.Storage.Load(id, tenant); err != nil {
+		return ctx.JSON(http.StatusNotFound, ErrorResp{Error: err.Error()})
+	}
+
+	var u metadata.Update
+	if err := json.NewDecoder(ctx.Request().Body).Decode(&u); err != nil {
+		return ctx.JSON(http.StatusBadRequest, ErrorResp{Error: err.Error()})
+	}
+
+	meta, err := v2.config.Metadata.Update(tenant, id, u)
+	if err != nil {
+		return ctx.JSON(http.StatusInternalServerError, ErrorResp{Error: err.Error()})
+	}
+
+	return ctx.JSON(http.StatusOK, meta)
+}
+
+// unreadCount returns the number of messages of the tenant which haven't
+// been read
+func (v2 *APIv2) unreadCount(tenant string) int {
+	read := v2.config.Metadata.Find(tenant, matchMeta("is", "read"))
+	n := v2.config.Storage.Count(tenant) - len(read)
+	if n < 0 {
+		return 0
+	}
+	return n
+}
+
+func (v2 *APIv2) unread(ctx echo.Context) error {
+	tenant, ok := ctx.Get("tenant").(string)
+	if !ok {
+		return ctx.JSON(http.StatusPreconditionRequired, echo.Map{
+			"error": "missing tenant id in request context",
+		})
+	}
+
+	return ctx.JSON(http.StatusOK, echo.Map{"unread": v2.unreadCount(tenant)})
+}
+
+func (v2 *APIv2) auth(ctx echo.Context) error {
+	tenant, ok := ctx.Get("tenant").(string)
+	if !ok {
+		return ctx.JSON(http.StatusPreconditionRequired, echo.Map{
+			"error": "missing tenant id in request context",
+		})
+	}
+
+	auth := v2.config.Metadata.Get(tenant, ctx.Param("id")).Auth
+	if auth == nil {
+		return ctx.JSON(http.StatusNotFound, ErrorResp{Error: "message wasn't verified"})
+	}
+
+	return ctx.JSON(http.StatusOK, auth)
+}
+
+func (v2 *APIv2) session(ctx echo.Context) error {
+	tenant, ok := ctx.Get("tenant").(string)
+	if !ok {
+		return ctx.JSON(http.StatusPreconditionRequired, echo.Map{
+			"error": "missing tenant id in request context",
+		})
+	}
+
+	session := v2.config.Metadata.Get(tenant, ctx.Param("id")).Session
+	if session == nil {
+		return ctx.JSON(http.StatusNotFound, ErrorResp{Error: "no session recorded for message"})
+	}
+
+	return ctx.JSON(http.StatusOK, session)
+}
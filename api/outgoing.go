@@ -0,0 +1,121 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/jay-dee7/MailHog-Server/release"
+	"github.com/labstack/echo/v4"
+)
+
+func (v2 *APIv2) listOutgoingSMTP(ctx echo.Context) error {
+	tenant, ok := ctx.Get("tenant").(string)
+	if !ok {
+		return ctx.JSON(http.StatusPreconditionRequired, echo.Map{
+			"error": "missing tenant id in request context",
+		})
+	}
+
+	servers := v2.config.OutgoingServers.List(tenant)
+	for i, s := range servers {
+		servers[i] = s.Redacted()
+	}
+
+	return ctx.JSON(http.StatusOK, servers)
+}
+
+func (v2 *APIv2) getOutgoingSMTP(ctx echo.Context) error {
+	tenant, ok := ctx.Get("tenant").(string)
+	if !ok {
+		return ctx.JSON(http.StatusPreconditionRequired, echo.Map{
+			"error": "missing tenant id in request context",
+		})
+	}
+
+	server, ok := v2.config.OutgoingServers.Get(tenant, ctx.Param("name"))
+	if !ok {
+		return ctx.JSON(http.StatusNotFound, ErrorResp{Error: release.ErrServerNotFound.Error()})
+	}
+
+	return ctx.JSON(http.StatusOK, server.Redacted())
+}
+
+func (v2 *APIv2) putOutgoingSMTP(ctx echo.Context) error {
+	tenant, ok := ctx.Get("tenant").(string)
+	if !ok {
+		return ctx.JSON(http.StatusPreconditionRequired, echo.Map{
+			"error": "missing tenant id in request context",
+		})
+	}
+
+	var server release.Server
+	if err := json.NewDecoder(ctx.Request().Body).Decode(&server); err != nil {
+		return ctx.JSON(http.StatusBadRequest, ErrorResp{Error: err.Error()})
+	}
+	server.Name = ctx.Param("name")
+
+	// secrets are never returned, so an update without them keeps those of
+	// the tenant's server it replaces, never those of a shared server
+	old, _ := v2.config.OutgoingServers.GetOwn(tenant, server.Name)
+	if err := server.CheckInput(old); err != nil {
+		return ctx.JSON(http.StatusBadRequest, ErrorResp{Error: err.Error()})
+	}
+
+	if len(server.Host) == 0 {
+		return ctx.JSON(http.StatusBadRequest, ErrorResp{Error: release.ErrInvalidServer.Error()})
+	}
+	if err := server.Validate(); err != nil {
+		return ctx.JSON(http.StatusBadRequest, ErrorResp{Error: err.Error()})
+	}
+	if err := v2.config.OutgoingServers.Put(tenant, &server); err != nil {
+		return ctx.JSON(http.StatusInternalServerError, ErrorResp{Error: err.Error()})
+	}
+
+	return ctx.JSON(http.StatusOK, server.Redacted())
+}
+
+func (v2 *APIv2) deleteOutgoingSMTP(ctx echo.Context) error {
+	tenant, ok := ctx.Get("tenant").(string)
+	if !ok {
+		return ctx.JSON(http.StatusPreconditionRequired, echo.Map{
+			"error": "missing tenant id in request context",
+		})
+	}
+
+	err := v2.config.OutgoingServers.Delete(tenant, ctx.Param("name"))
+	switch {
+	case err == release.ErrServerNotFound:
+		return ctx.JSON(http.StatusNotFound, ErrorResp{Error: err.Error()})
+	case err != nil:
+		return ctx.JSON(http.StatusInternalServerError, ErrorResp{Error: err.Error()})
+	}
+
+	return ctx.JSON(http.StatusOK, nil)
+}
+
+// testOutgoingSMTP connects to a server, negotiating TLS and authenticating,
+// without sending a message
+func (v2 *APIv2) testOutgoingSMTP(ctx echo.Context) error {
+	tenant, ok := ctx.Get("tenant").(string)
+	if !ok {
+		return ctx.JSON(http.StatusPreconditionRequired, echo.Map{
+			"error": "missing tenant id in request context",
+		})
+	}
+
+	server, ok := v2.config.OutgoingServers.Get(tenant, ctx.Param("name"))
+	if !ok {
+		return ctx.JSON(http.StatusNotFound, ErrorResp{Error: release.ErrServerNotFound.Error()})
+	}
+
+	c, err := server.Dial()
+	if err != nil {
+		return ctx.JSON(http.StatusBadGateway, ErrorResp{Error: err.Error()})
+	}
+	defer c.Close()
+	if err := c.Quit(); err != nil {
+		return ctx.JSON(http.StatusBadGateway, ErrorResp{Error: err.Error()})
+	}
+
+	return ctx.JSON(http.StatusOK, echo.Map{"ok": true})
+}
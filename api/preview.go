@@ -0,0 +1,380 @@
+package api
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/jay-dee7/MailHog-Server/mimetree"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/net/html"
+)
+
+// Remote resource policies for the HTML preview
+const (
+	remoteBlock = "block"
+	remoteProxy = "proxy"
+	remoteAllow = "allow"
+)
+
+// maxProxySize limits the size of a remote resource fetched by the preview proxy
+const maxProxySize = 10 << 20
+
+// proxyClient fetches remote resources for the preview proxy. It doesn't
+// follow redirects and only connects to public addresses, so that messages
+// can't make MailHog request internal services.
+var proxyClient = &http.Client{
+	Timeout: 10 * time.Second,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 5 * time.Second,
+			Control: publicOnly,
+		}).DialContext,
+	},
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// privateNetworks are the ranges the preview proxy refuses to connect to
+var privateNetworks = parseNetworks(
+	"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16",
+	"172.16.0.0/12", "192.0.0.0/24", "192.168.0.0/16", "198.18.0.0/15", "224.0.0.0/3",
+	"::/128", "::1/128", "fc00::/7", "fe80::/10", "ff00::/8",
+)
+
+func parseNetworks(cidrs ...string) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, n)
+	}
+	return networks
+}
+
+// isPublicIP returns true if ip isn't loopback, link-local, private or
+// otherwise reserved
+func isPublicIP(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	for _, n := range privateNetworks {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// publicOnly is a net.Dialer Control function refusing to connect to
+// addresses which aren't public, it runs after the host is resolved
+func publicOnly(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+		return errors.New("proxy refuses to connect to " + host)
+	}
+	return nil
+}
+
+// elements which are removed from the preview along with their content
+var unsafeElements = map[string]bool{
+	"script": true,
+	"iframe": true,
+	"frame":  true,
+	"object": true,
+	"embed":  true,
+	"applet": true,
+	"base":   true,
+}
+
+// attributes which cause the browser to load a resource
+var resourceAttributes = map[string]bool{
+	"src":        true,
+	"background": true,
+	"poster":     true,
+	"srcset":     true,
+}
+
+var cssURLRegexp = regexp.MustCompile(`(?i)url\(\s*['"]?([^'")]*)['"]?\s*\)`)
+
+// cssImportRegexp matches @import rules using a string instead of url()
+var cssImportRegexp = regexp.MustCompile(`(?i)@import\s*(?:"([^"]*)"|'([^']*)')([^;]*;?)`)
+
+// elements whose href attribute is a resource which the browser loads
+var hrefResourceElements = map[string]bool{
+	"link":    true,
+	"image":   true,
+	"use":     true,
+	"feImage": true,
+}
+
+// previewRewriter rewrites the HTML part of a message so that it can be
+// displayed safely in a browser
+type previewRewriter struct {
+	// cids maps Content-IDs to the download URL of the matching part
+	cids   map[string]string
+	remote string
+	proxy  string
+	// proxied holds the remote URLs which were rewritten to the proxy
+	proxied map[string]bool
+}
+
+func (v2 *APIv2) newPreviewRewriter(id string, tree *mimetree.Part, remote string) *previewRewriter {
+	r := &previewRewriter{
+		cids:    make(map[string]string),
+		remote:  remote,
+		proxy:   v2.config.WebPath + "/api/v2/messages/" + url.PathEscape(id) + "/proxy?url=",
+		proxied: make(map[string]bool),
+	}
+	tree.Walk(func(p *mimetree.Part) {
+		if cid := p.ContentID(); len(cid) > 0 {
+			r.cids[cid] = v2.config.WebPath + "/api/v1/messages/" + url.PathEscape(id) + "/mime/part/" + p.ID() + "/download"
+		}
+	})
+	return r
+}
+
+// resource rewrites the URL of a resource which the browser loads
+// automatically, returning an empty string if it must be dropped
+func (r *previewRewriter) resource(u string) string {
+	u = strings.TrimSpace(u)
+	lower := strings.ToLower(u)
+	switch {
+	case strings.HasPrefix(lower, "cid:"):
+		cid, _ := url.PathUnescape(u[4:])
+		return r.cids[strings.Trim(cid, "<>")]
+	case strings.HasPrefix(lower, "data:"):
+		return u
+	case strings.HasPrefix(lower, "http://"), strings.HasPrefix(lower, "https://"), strings.HasPrefix(lower, "//"):
+		switch r.remote {
+		case remoteAllow:
+			return u
+		case remoteProxy:
+			if strings.HasPrefix(u, "//") {
+				u = "https:" + u
+			}
+			r.proxied[u] = true
+			return r.proxy + url.QueryEscape(u)
+		}
+	}
+	return ""
+}
+
+func (r *previewRewriter) css(s string) string {
+	s = cssURLRegexp.ReplaceAllStringFunc(s, func(m string) string {
+		u := r.resource(cssURLRegexp.FindStringSubmatch(m)[1])
+		if len(u) == 0 {
+			return "none"
+		}
+		return "url('" + u + "')"
+	})
+	return cssImportRegexp.ReplaceAllStringFunc(s, func(m string) string {
+		sub := cssImportRegexp.FindStringSubmatch(m)
+		u := r.resource(sub[1] + sub[2])
+		if len(u) == 0 {
+			return ""
+		}
+		return "@import url('" + u + "')" + sub[3]
+	})
+}
+
+func (r *previewRewriter) rewrite(n *html.Node) {
+	for c := n.FirstChild; c != nil; {
+		next := c.NextSibling
+		if c.Type == html.ElementNode && unsafeElements[c.Data] {
+			n.RemoveChild(c)
+		} else {
+			r.rewrite(c)
+		}
+		c = next
+	}
+
+	switch n.Type {
+	case html.TextNode:
+		if n.Parent != nil && n.Parent.Data == "style" {
+			n.Data = r.css(n.Data)
+		}
+		return
+	case html.ElementNode:
+	default:
+		return
+	}
+
+	attrs := n.Attr[:0]
+	for _, a := range n.Attr {
+		key := strings.ToLower(a.Key)
+		switch {
+		case strings.HasPrefix(key, "on"):
+			continue
+		case key == "style":
+			a.Val = r.css(a.Val)
+		case key == "href" && (hrefResourceElements[n.Data] || (a.Namespace == "xlink" && n.Data != "a")):
+			if a.Val = r.resource(a.Val); len(a.Val) == 0 {
+				continue
+			}
+		case key == "href":
+			if strings.HasPrefix(strings.ToLower(strings.TrimSpace(a.Val)), "javascript:") {
+				continue
+			}
+		case key == "srcset":
+			// srcset can't hold cid: references and rewriting each candidate
+			// isn't worth it, so remote images fall back to src
+			if r.remote != remoteAllow {
+				continue
+			}
+		case resourceAttributes[key]:
+			if a.Val = r.resource(a.Val); len(a.Val) == 0 {
+				continue
+			}
+		}
+		attrs = append(attrs, a)
+	}
+	n.Attr = attrs
+}
+
+func findPart(tree *mimetree.Part, contentType string) *mimetree.Part {
+	var found *mimetree.Part
+	tree.Walk(func(p *mimetree.Part) {
+		if found == nil && p.ContentType == contentType && p.Disposition() != "attachment" {
+			found = p
+		}
+	})
+	return found
+}
+
+func (v2 *APIv2) preview(ctx echo.Context) error {
+	id := ctx.Param("id")
+	tenant, ok := ctx.Get("tenant").(string)
+	if !ok {
+		return ctx.JSON(http.StatusPreconditionRequired, echo.Map{
+			"error": "missing tenant id in request context",
+		})
+	}
+
+	remote := ctx.QueryParam("remote")
+	switch remote {
+	case "":
+		remote = remoteBlock
+	case remoteBlock, remoteProxy, remoteAllow:
+	default:
+		return ctx.JSON(http.StatusBadRequest, ErrorResp{Error: "invalid remote param: " + remote})
+	}
+
+	message, err := v2.config.Storage.Load(id, tenant)
+	if err != nil {
+		return ctx.JSON(http.StatusNotFound, ErrorResp{Error: err.Error()})
+	}
+
+	tree, err := mimetree.Parse(mimetree.Raw(message))
+	if err != nil {
+		return ctx.JSON(http.StatusInternalServerError, ErrorResp{Error: err.Error()})
+	}
+
+	htmlPart := findPart(tree, "text/html")
+	if htmlPart == nil || ctx.QueryParam("view") == "text" {
+		textPart := findPart(tree, "text/plain")
+		if textPart == nil {
+			return ctx.JSON(http.StatusNotFound, ErrorResp{Error: "message has no text part"})
+		}
+		text, err := textPart.Text()
+		if err != nil {
+			return ctx.JSON(http.StatusInternalServerError, ErrorResp{Error: err.Error()})
+		}
+		return ctx.String(http.StatusOK, text)
+	}
+
+	doc, _, err := v2.previewDocument(id, tree, htmlPart, remote)
+	if err != nil {
+		return ctx.JSON(http.StatusInternalServerError, ErrorResp{Error: err.Error()})
+	}
+
+	var b bytes.Buffer
+	if err := html.Render(&b, doc); err != nil {
+		return ctx.JSON(http.StatusInternalServerError, ErrorResp{Error: err.Error()})
+	}
+
+	ctx.Response().Header().Set("Content-Security-Policy", "script-src 'none'; object-src 'none'; frame-src 'none'")
+	return ctx.HTMLBlob(http.StatusOK, b.Bytes())
+}
+
+// previewDocument parses and rewrites the HTML part of a message
+func (v2 *APIv2) previewDocument(id string, tree, htmlPart *mimetree.Part, remote string) (*html.Node, *previewRewriter, error) {
+	text, err := htmlPart.Text()
+	if err != nil {
+		return nil, nil, err
+	}
+	doc, err := html.Parse(strings.NewReader(text))
+	if err != nil {
+		return nil, nil, err
+	}
+	r := v2.newPreviewRewriter(id, tree, remote)
+	r.rewrite(doc)
+	return doc, r, nil
+}
+
+// proxy fetches a remote image or stylesheet referenced by the preview of a
+// message, other URLs are refused
+func (v2 *APIv2) proxy(ctx echo.Context) error {
+	id := ctx.Param("id")
+	tenant, ok := ctx.Get("tenant").(string)
+	if !ok {
+		return ctx.JSON(http.StatusPreconditionRequired, echo.Map{
+			"error": "missing tenant id in request context",
+		})
+	}
+
+	raw := ctx.QueryParam("url")
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return ctx.JSON(http.StatusBadRequest, ErrorResp{Error: "invalid proxy url"})
+	}
+
+	message, err := v2.config.Storage.Load(id, tenant)
+	if err != nil {
+		return ctx.JSON(http.StatusNotFound, ErrorResp{Error: err.Error()})
+	}
+	tree, err := mimetree.Parse(mimetree.Raw(message))
+	if err != nil {
+		return ctx.JSON(http.StatusInternalServerError, ErrorResp{Error: err.Error()})
+	}
+	htmlPart := findPart(tree, "text/html")
+	if htmlPart == nil {
+		return ctx.JSON(http.StatusForbidden, ErrorResp{Error: "url isn't referenced by the message"})
+	}
+	_, r, err := v2.previewDocument(id, tree, htmlPart, remoteProxy)
+	if err != nil {
+		return ctx.JSON(http.StatusInternalServerError, ErrorResp{Error: err.Error()})
+	}
+	if !r.proxied[raw] {
+		return ctx.JSON(http.StatusForbidden, ErrorResp{Error: "url isn't referenced by the message"})
+	}
+
+	resp, err := proxyClient.Get(raw)
+	if err != nil {
+		return ctx.JSON(http.StatusBadGateway, ErrorResp{Error: err.Error()})
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 && resp.StatusCode < 400 {
+		return ctx.JSON(http.StatusBadGateway, ErrorResp{Error: "proxy doesn't follow redirects"})
+	}
+	contentType := resp.Header.Get("Content-Type")
+	if !strings.HasPrefix(contentType, "image/") && !strings.HasPrefix(contentType, "text/css") && !strings.HasPrefix(contentType, "font/") {
+		return ctx.JSON(http.StatusForbidden, ErrorResp{Error: "unsupported proxy content type: " + contentType})
+	}
+
+	return ctx.Stream(resp.StatusCode, contentType, io.LimitReader(resp.Body, maxProxySize))
+}
@@ -0,0 +1,88 @@
+package api
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/net/html"
+)
+
+func renderPreview(r *previewRewriter, in string) string {
+	doc, _ := html.Parse(strings.NewReader(in))
+	r.rewrite(doc)
+	var b bytes.Buffer
+	html.Render(&b, doc)
+	return b.String()
+}
+
+func TestPreviewRewriter(t *testing.T) {
+	tests := []struct {
+		name     string
+		remote   string
+		in       string
+		contains []string
+		excludes []string
+	}{
+		{"cid images", remoteBlock, `<img src="cid:logo@mailhog.example">`, []string{`src="/mime/logo"`}, nil},
+		{"remote images", remoteBlock, `<img src="https://t.example/p.gif">`, nil, []string{"t.example"}},
+		{"scripts", remoteBlock, `<script>alert(1)</script><p onclick="x()">Hi</p>`, []string{"Hi"}, []string{"alert", "onclick"}},
+		{"javascript links", remoteBlock, `<a href="javascript:x()">Hi</a>`, nil, []string{"javascript"}},
+		{"css urls", remoteBlock, `<div style="background:url(https://t.example/b.png)">Hi</div>`, []string{"background:none"}, []string{"t.example"}},
+		{"css imports", remoteBlock, `<style>@import "https://t.example/a.css"; p { color: red }</style>`, []string{"color: red"}, []string{"t.example", "@import"}},
+		{"svg images", remoteBlock, `<svg><image xlink:href="https://t.example/i.png"/><use href="https://t.example/u.svg"/></svg>`, nil, []string{"t.example"}},
+		{"proxied images", remoteProxy, `<img src="//t.example/p.gif">`, []string{`src="/proxy?url=https%3A%2F%2Ft.example%2Fp.gif"`}, nil},
+		{"proxied imports", remoteProxy, `<style>@import 'https://t.example/a.css' screen;</style>`, []string{"@import url('/proxy?url=https%3A%2F%2Ft.example%2Fa.css') screen;"}, nil},
+		{"allowed images", remoteAllow, `<img src="https://t.example/p.gif">`, []string{`src="https://t.example/p.gif"`}, nil},
+	}
+
+	for _, test := range tests {
+		Convey("previewRewriter should rewrite "+test.name, t, func() {
+			r := &previewRewriter{
+				cids:    map[string]string{"logo@mailhog.example": "/mime/logo"},
+				remote:  test.remote,
+				proxy:   "/proxy?url=",
+				proxied: make(map[string]bool),
+			}
+			out := renderPreview(r, test.in)
+			for _, s := range test.contains {
+				So(out, ShouldContainSubstring, s)
+			}
+			for _, s := range test.excludes {
+				So(out, ShouldNotContainSubstring, s)
+			}
+		})
+	}
+
+	Convey("previewRewriter should record the proxied URLs", t, func() {
+		r := &previewRewriter{remote: remoteProxy, proxy: "/proxy?url=", proxied: make(map[string]bool)}
+		renderPreview(r, `<img src="https://t.example/p.gif"><a href="https://t.example/page">Hi</a>`)
+		So(r.proxied, ShouldResemble, map[string]bool{"https://t.example/p.gif": true})
+	})
+}
+
+func TestIsPublicIP(t *testing.T) {
+	tests := map[string]bool{
+		"93.184.216.34":    true,
+		"2606:2800::1":     true,
+		"127.0.0.1":        false,
+		"10.1.2.3":         false,
+		"172.16.0.1":       false,
+		"192.168.1.1":      false,
+		"169.254.169.254":  false,
+		"100.64.0.1":       false,
+		"0.0.0.0":          false,
+		"::1":              false,
+		"::ffff:127.0.0.1": false,
+		"fd00::1":          false,
+		"fe80::1":          false,
+	}
+
+	Convey("isPublicIP should refuse loopback, link-local and private addresses", t, func() {
+		for ip, public := range tests {
+			So(isPublicIP(net.ParseIP(ip)), ShouldEqual, public)
+		}
+	})
+}
@@ -0,0 +1,68 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/jay-dee7/MailHog-Server/rules"
+	"github.com/labstack/echo/v4"
+)
+
+func (v2 *APIv2) listRules(ctx echo.Context) error {
+	tenant, ok := ctx.Get("tenant").(string)
+	if !ok {
+		return ctx.JSON(http.StatusPreconditionRequired, echo.Map{
+			"error": "missing tenant id in request context",
+		})
+	}
+
+	return ctx.JSON(http.StatusOK, v2.config.Rules.List(tenant))
+}
+
+func (v2 *APIv2) putRule(ctx echo.Context) error {
+	tenant, ok := ctx.Get("tenant").(string)
+	if !ok {
+		return ctx.JSON(http.StatusPreconditionRequired, echo.Map{
+			"error": "missing tenant id in request context",
+		})
+	}
+
+	var rule rules.Rule
+	if err := json.NewDecoder(ctx.Request().Body).Decode(&rule); err != nil {
+		return ctx.JSON(http.StatusBadRequest, ErrorResp{Error: err.Error()})
+	}
+	rule.Name = ctx.Param("name")
+
+	for _, a := range rule.Actions {
+		if a.Type != rules.Forward {
+			continue
+		}
+		if _, ok := v2.config.OutgoingServers.Get(tenant, a.Server); !ok {
+			return ctx.JSON(http.StatusBadRequest, ErrorResp{Error: "server not found: " + a.Server})
+		}
+	}
+	if err := v2.config.Rules.Put(tenant, rule); err != nil {
+		return ctx.JSON(http.StatusBadRequest, ErrorResp{Error: err.Error()})
+	}
+
+	return ctx.JSON(http.StatusOK, rule)
+}
+
+func (v2 *APIv2) deleteRule(ctx echo.Context) error {
+	tenant, ok := ctx.Get("tenant").(string)
+	if !ok {
+		return ctx.JSON(http.StatusPreconditionRequired, echo.Map{
+			"error": "missing tenant id in request context",
+		})
+	}
+
+	err := v2.config.Rules.Delete(tenant, ctx.Param("name"))
+	switch {
+	case err == rules.ErrRuleNotFound:
+		return ctx.JSON(http.StatusNotFound, ErrorResp{Error: err.Error()})
+	case err != nil:
+		return ctx.JSON(http.StatusInternalServerError, ErrorResp{Error: err.Error()})
+	}
+
+	return ctx.JSON(http.StatusOK, nil)
+}
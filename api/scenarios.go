@@ -0,0 +1,71 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/jay-dee7/MailHog-Server/scenario"
+	"github.com/labstack/echo/v4"
+)
+
+func (v2 *APIv2) listScenarios(ctx echo.Context) error {
+	tenant, ok := ctx.Get("tenant").(string)
+	if !ok {
+		return ctx.JSON(http.StatusPreconditionRequired, echo.Map{
+			"error": "missing tenant id in request context",
+		})
+	}
+
+	return ctx.JSON(http.StatusOK, v2.config.Scenarios.List(tenant))
+}
+
+func (v2 *APIv2) putScenario(ctx echo.Context) error {
+	tenant, ok := ctx.Get("tenant").(string)
+	if !ok {
+		return ctx.JSON(http.StatusPreconditionRequired, echo.Map{
+			"error": "missing tenant id in request context",
+		})
+	}
+
+	var sc scenario.Scenario
+	if err := json.NewDecoder(ctx.Request().Body).Decode(&sc); err != nil {
+		return ctx.JSON(http.StatusBadRequest, ErrorResp{Error: err.Error()})
+	}
+	sc.Name = ctx.Param("name")
+
+	if err := v2.config.Scenarios.Put(tenant, sc); err != nil {
+		return ctx.JSON(http.StatusBadRequest, ErrorResp{Error: err.Error()})
+	}
+
+	return ctx.JSON(http.StatusOK, sc)
+}
+
+func (v2 *APIv2) resetScenario(ctx echo.Context) error {
+	tenant, ok := ctx.Get("tenant").(string)
+	if !ok {
+		return ctx.JSON(http.StatusPreconditionRequired, echo.Map{
+			"error": "missing tenant id in request context",
+		})
+	}
+
+	if err := v2.config.Scenarios.Reset(tenant, ctx.Param("name")); err != nil {
+		return ctx.JSON(http.StatusNotFound, ErrorResp{Error: err.Error()})
+	}
+
+	return ctx.JSON(http.StatusOK, nil)
+}
+
+func (v2 *APIv2) deleteScenario(ctx echo.Context) error {
+	tenant, ok := ctx.Get("tenant").(string)
+	if !ok {
+		return ctx.JSON(http.StatusPreconditionRequired, echo.Map{
+			"error": "missing tenant id in request context",
+		})
+	}
+
+	if err := v2.config.Scenarios.Delete(tenant, ctx.Param("name")); err != nil {
+		return ctx.JSON(http.StatusNotFound, ErrorResp{Error: err.Error()})
+	}
+
+	return ctx.JSON(http.StatusOK, nil)
+}
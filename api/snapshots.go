@@ -0,0 +1,134 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/jay-dee7/MailHog-Server/msgdiff"
+	"github.com/labstack/echo/v4"
+)
+
+// snapshotRequest takes a snapshot of a message
+type snapshotRequest struct {
+	MessageID string   `json:"messageId"`
+	Ignore    []string `json:"ignore"`
+}
+
+// compareResult is the comparison of a message against a snapshot
+type compareResult struct {
+	Snapshot  string `json:"snapshot"`
+	MessageID string `json:"messageId"`
+	msgdiff.Result
+}
+
+func (v2 *APIv2) listSnapshots(ctx echo.Context) error {
+	tenant, ok := ctx.Get("tenant").(string)
+	if !ok {
+		return ctx.JSON(http.StatusPreconditionRequired, echo.Map{
+			"error": "missing tenant id in request context",
+		})
+	}
+
+	return ctx.JSON(http.StatusOK, v2.config.Snapshots.List(tenant))
+}
+
+func (v2 *APIv2) getSnapshot(ctx echo.Context) error {
+	tenant, ok := ctx.Get("tenant").(string)
+	if !ok {
+		return ctx.JSON(http.StatusPreconditionRequired, echo.Map{
+			"error": "missing tenant id in request context",
+		})
+	}
+
+	snap, ok := v2.config.Snapshots.Get(tenant, ctx.Param("name"))
+	if !ok {
+		return ctx.JSON(http.StatusNotFound, ErrorResp{Error: msgdiff.ErrSnapshotNotFound.Error()})
+	}
+
+	return ctx.JSON(http.StatusOK, snap)
+}
+
+func (v2 *APIv2) putSnapshot(ctx echo.Context) error {
+	tenant, ok := ctx.Get("tenant").(string)
+	if !ok {
+		return ctx.JSON(http.StatusPreconditionRequired, echo.Map{
+			"error": "missing tenant id in request context",
+		})
+	}
+
+	var req snapshotRequest
+	if err := json.NewDecoder(ctx.Request().Body).Decode(&req); err != nil {
+		return ctx.JSON(http.StatusBadRequest, ErrorResp{Error: err.Error()})
+	}
+
+	msg, err := v2.config.Storage.Load(req.MessageID, tenant)
+	if err != nil {
+		return ctx.JSON(http.StatusNotFound, ErrorResp{Error: err.Error()})
+	}
+	r, err := msgdiff.Render(msg)
+	if err != nil {
+		return ctx.JSON(http.StatusUnprocessableEntity, ErrorResp{Error: err.Error()})
+	}
+
+	snap, err := v2.config.Snapshots.Put(tenant, msgdiff.Snapshot{
+		Name:      ctx.Param("name"),
+		MessageID: req.MessageID,
+		Ignore:    req.Ignore,
+		Created:   time.Now(),
+		Rendition: *r,
+	})
+	if err != nil {
+		return ctx.JSON(http.StatusBadRequest, ErrorResp{Error: err.Error()})
+	}
+
+	return ctx.JSON(http.StatusOK, snap)
+}
+
+func (v2 *APIv2) deleteSnapshot(ctx echo.Context) error {
+	tenant, ok := ctx.Get("tenant").(string)
+	if !ok {
+		return ctx.JSON(http.StatusPreconditionRequired, echo.Map{
+			"error": "missing tenant id in request context",
+		})
+	}
+
+	err := v2.config.Snapshots.Delete(tenant, ctx.Param("name"))
+	switch {
+	case err == msgdiff.ErrSnapshotNotFound:
+		return ctx.JSON(http.StatusNotFound, ErrorResp{Error: err.Error()})
+	case err != nil:
+		return ctx.JSON(http.StatusInternalServerError, ErrorResp{Error: err.Error()})
+	}
+
+	return ctx.JSON(http.StatusOK, nil)
+}
+
+func (v2 *APIv2) compareSnapshot(ctx echo.Context) error {
+	id := ctx.Param("id")
+	tenant, ok := ctx.Get("tenant").(string)
+	if !ok {
+		return ctx.JSON(http.StatusPreconditionRequired, echo.Map{
+			"error": "missing tenant id in request context",
+		})
+	}
+
+	snap, ok := v2.config.Snapshots.Get(tenant, ctx.Param("name"))
+	if !ok {
+		return ctx.JSON(http.StatusNotFound, ErrorResp{Error: msgdiff.ErrSnapshotNotFound.Error()})
+	}
+	msg, err := v2.config.Storage.Load(id, tenant)
+	if err != nil {
+		return ctx.JSON(http.StatusNotFound, ErrorResp{Error: err.Error()})
+	}
+	r, err := msgdiff.Render(msg)
+	if err != nil {
+		return ctx.JSON(http.StatusUnprocessableEntity, ErrorResp{Error: err.Error()})
+	}
+
+	return ctx.JSON(http.StatusOK, compareResult{
+		Snapshot:  snap.Name,
+		MessageID: id,
+		Result:    snap.Compare(r),
+	})
+}
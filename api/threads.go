@@ -0,0 +1,97 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/jay-dee7/MailHog-Server/threading"
+	"github.com/labstack/echo/v4"
+	"github.com/mailhog/data"
+)
+
+type threadsResult struct {
+	Total int                `json:"total"`
+	Count int                `json:"count"`
+	Start int                `json:"start"`
+	Items []threading.Thread `json:"items"`
+}
+
+type threadResult struct {
+	threading.Thread
+	Messages []messageItem `json:"messages"`
+}
+
+// maxThreadMessages bounds the messages grouped into threads for each request
+const maxThreadMessages = 1000
+
+// threads groups the most recent messages of the tenant into threads
+func (v2 *APIv2) threads(tenant string) ([]threading.Thread, *data.Messages, error) {
+	messages, err := v2.config.Storage.List(0, maxThreadMessages, tenant)
+	if err != nil {
+		return nil, nil, err
+	}
+	return threading.Build(*messages), messages, nil
+}
+
+func (v2 *APIv2) listThreads(ctx echo.Context) error {
+	start, limit := v2.getStartLimit(ctx.QueryParams())
+
+	tenant, ok := ctx.Get("tenant").(string)
+	if !ok {
+		return ctx.JSON(http.StatusPreconditionRequired, echo.Map{
+			"error": "missing tenant id in request context",
+		})
+	}
+
+	threads, _, err := v2.threads(tenant)
+	if err != nil {
+		return ctx.JSON(http.StatusInternalServerError, ErrorResp{Error: err.Error()})
+	}
+
+	items := []threading.Thread{}
+	if start < len(threads) {
+		items = threads[start:]
+		if len(items) > limit {
+			items = items[:limit]
+		}
+	}
+
+	return ctx.JSON(http.StatusOK, threadsResult{
+		Total: len(threads),
+		Count: len(items),
+		Start: start,
+		Items: items,
+	})
+}
+
+func (v2 *APIv2) thread(ctx echo.Context) error {
+	id := ctx.Param("id")
+	tenant, ok := ctx.Get("tenant").(string)
+	if !ok {
+		return ctx.JSON(http.StatusPreconditionRequired, echo.Map{
+			"error": "missing tenant id in request context",
+		})
+	}
+
+	threads, messages, err := v2.threads(tenant)
+	if err != nil {
+		return ctx.JSON(http.StatusInternalServerError, ErrorResp{Error: err.Error()})
+	}
+
+	for _, t := range threads {
+		if t.ID != id {
+			continue
+		}
+
+		byID := make(map[string]data.Message)
+		for _, m := range *messages {
+			byID[string(m.ID)] = m
+		}
+		thread := data.Messages{}
+		for _, mid := range t.MessageIDs {
+			thread = append(thread, byID[mid])
+		}
+		return ctx.JSON(http.StatusOK, threadResult{t, v2.withMeta(tenant, &thread)})
+	}
+
+	return ctx.JSON(http.StatusNotFound, ErrorResp{Error: "thread not found"})
+}
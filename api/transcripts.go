@@ -0,0 +1,60 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+func (v2 *APIv2) listTranscripts(ctx echo.Context) error {
+	tenant, ok := ctx.Get("tenant").(string)
+	if !ok {
+		return ctx.JSON(http.StatusPreconditionRequired, echo.Map{
+			"error": "missing tenant id in request context",
+		})
+	}
+
+	if v2.config.Transcripts == nil {
+		return ctx.JSON(http.StatusNotFound, ErrorResp{Error: "transcripts are disabled"})
+	}
+
+	return ctx.JSON(http.StatusOK, v2.config.Transcripts.List(tenant, ctx.QueryParam("failed") == "true"))
+}
+
+func (v2 *APIv2) getTranscript(ctx echo.Context) error {
+	tenant, ok := ctx.Get("tenant").(string)
+	if !ok {
+		return ctx.JSON(http.StatusPreconditionRequired, echo.Map{
+			"error": "missing tenant id in request context",
+		})
+	}
+
+	if v2.config.Transcripts == nil {
+		return ctx.JSON(http.StatusNotFound, ErrorResp{Error: "transcripts are disabled"})
+	}
+	t, ok := v2.config.Transcripts.Get(tenant, ctx.Param("id"))
+	if !ok {
+		return ctx.JSON(http.StatusNotFound, ErrorResp{Error: "transcript not found"})
+	}
+
+	return ctx.JSON(http.StatusOK, t)
+}
+
+func (v2 *APIv2) messageTranscript(ctx echo.Context) error {
+	tenant, ok := ctx.Get("tenant").(string)
+	if !ok {
+		return ctx.JSON(http.StatusPreconditionRequired, echo.Map{
+			"error": "missing tenant id in request context",
+		})
+	}
+
+	if v2.config.Transcripts == nil {
+		return ctx.JSON(http.StatusNotFound, ErrorResp{Error: "transcripts are disabled"})
+	}
+	t, ok := v2.config.Transcripts.ForMessage(tenant, ctx.Param("id"))
+	if !ok {
+		return ctx.JSON(http.StatusNotFound, ErrorResp{Error: "transcript not found"})
+	}
+
+	return ctx.JSON(http.StatusOK, t)
+}
@@ -1,14 +1,10 @@
 package api
 
 import (
-	"encoding/base64"
 	"encoding/json"
 	"io"
 	"net"
 	"net/http"
-	"net/smtp"
-	"strconv"
-	"strings"
 	"time"
 
 	smtp2 "github.com/jay-dee7/MailHog-Server/smtp"
@@ -16,6 +12,10 @@ import (
 
 	"github.com/ian-kent/go-log/log"
 	"github.com/jay-dee7/MailHog-Server/config"
+	"github.com/jay-dee7/MailHog-Server/metadata"
+	"github.com/jay-dee7/MailHog-Server/mimetree"
+	"github.com/jay-dee7/MailHog-Server/release"
+	"github.com/jay-dee7/MailHog-Server/webhooks"
 	"github.com/jay-dee7/storage"
 	"github.com/mailhog/data"
 
@@ -38,8 +38,14 @@ type APIv1 struct {
 // FIXME should probably move this into APIv1 struct
 var stream *goose.EventStream
 
-// ReleaseConfig is an alias to preserve go package API
-type ReleaseConfig config.OutgoingSMTP
+// ReleaseConfig is the body of a release request
+//
+// The embedded server config names or describes the server to release
+// through. The embedded options control the envelope and headers.
+type ReleaseConfig struct {
+	config.OutgoingSMTP
+	release.Options
+}
 
 func (v1 APIv1) sendRawMessage(ctx echo.Context) error {
 	tenant, ok := ctx.Get("tenant").(string)
@@ -57,8 +63,12 @@ func (v1 APIv1) sendRawMessage(ctx echo.Context) error {
 	}
 	defer conn.Close()
 
-	if v1.config.Monkey != nil {
-		ok := v1.config.Monkey.Accept(conn)
+	monkey := v1.config.Monkey
+	if v1.config.Chaos != nil {
+		monkey = v1.config.Chaos.Monkey(tenant)
+	}
+	if monkey != nil {
+		ok := monkey.Accept(conn)
 		if !ok {
 			_ = conn.Close()
 			return ctx.JSON(http.StatusBadRequest, echo.Map{
@@ -70,10 +80,7 @@ func (v1 APIv1) sendRawMessage(ctx echo.Context) error {
 	smtp2.Accept(
 		conn.(*net.TCPConn).RemoteAddr().String(),
 		io.ReadWriteCloser(conn),
-		v1.config.Storage,
-		v1.config.MessageChan,
-		v1.config.Hostname,
-		v1.config.Monkey,
+		v1.config,
 		tenant,
 	)
 
@@ -176,11 +183,19 @@ func (v1 *APIv1) message(ctx echo.Context) error {
 		return ctx.JSON(http.StatusBadRequest, ErrorResp{Error: err.Error()})
 	}
 
+	// loading a message marks it as read, unless ?markRead=false
+	if ctx.QueryParam("markRead") != "false" && !v1.config.Metadata.Get(tenant, id).Read {
+		read := true
+		if _, err := v1.config.Metadata.Update(tenant, id, metadata.Update{Read: &read}); err != nil {
+			log.Printf("Error marking message %s as read: %s", id, err)
+		}
+	}
+
 	return ctx.JSON(http.StatusOK, message)
 }
 
 func (v1 *APIv1) download(ctx echo.Context) error {
-	id := ctx.QueryParams().Get(":id")
+	id := ctx.Param("id")
 	tenant, ok := ctx.Get("tenant").(string)
 	if !ok {
 		return ctx.JSON(http.StatusPreconditionRequired, echo.Map{
@@ -188,28 +203,19 @@ func (v1 *APIv1) download(ctx echo.Context) error {
 		})
 	}
 
-	ctx.Response().Header().Set("Content-Type", "message/rfc822")
-	ctx.Response().Header().Set("Content-Disposition", "attachment; filename=\""+id+".eml\"")
-
-	message, err := v1.config.Storage.(*storage.MultiTenantMongoDB).Load(id, tenant)
+	message, err := v1.config.Storage.Load(id, tenant)
 	if err != nil {
 		return ctx.JSON(http.StatusBadRequest, echo.Map{"error": err.Error()})
 	}
-	for h, l := range message.Content.Headers {
-		for _, v := range l {
-			_, _ = ctx.Response().Write([]byte(h + ": " + v + "\r\n"))
-		}
-	}
-	_, _ = ctx.Response().Write([]byte("\r\n" + message.Content.Body))
 
-	return nil
+	ctx.Response().Header().Set("Content-Disposition", "attachment; filename=\""+id+".eml\"")
+	return ctx.Blob(http.StatusOK, "message/rfc822", mimetree.Raw(message))
 }
 
 func (v1 *APIv1) downloadPart(ctx echo.Context) error {
 	id := ctx.Param("id")
-	part := ctx.Param("part")
+	path := ctx.Param("part")
 
-	ctx.Response().Header().Set("Content-Disposition", "attachment; filename=\""+id+"-part-"+part+"\"")
 	tenant, ok := ctx.Get("tenant").(string)
 	if !ok {
 		return ctx.JSON(http.StatusPreconditionRequired, echo.Map{
@@ -217,36 +223,44 @@ func (v1 *APIv1) downloadPart(ctx echo.Context) error {
 		})
 	}
 
-	message, _ := v1.config.Storage.Load(id, tenant)
-	contentTransferEncoding := ""
-	pid, _ := strconv.Atoi(part)
-	for h, l := range message.MIME.Parts[pid].Headers {
-		for _, v := range l {
-			switch strings.ToLower(h) {
-			case "content-disposition":
-				// Prevent duplicate "content-disposition"
-				ctx.Response().Header().Set(h, v)
-			case "content-transfer-encoding":
-				if contentTransferEncoding == "" {
-					contentTransferEncoding = v
-				}
-				fallthrough
-			default:
-				ctx.Response().Header().Add(h, v)
-			}
-		}
+	message, err := v1.config.Storage.Load(id, tenant)
+	if err != nil {
+		return ctx.JSON(http.StatusNotFound, ErrorResp{Error: err.Error()})
+	}
+
+	tree, err := mimetree.Parse(mimetree.Raw(message))
+	if err != nil {
+		return ctx.JSON(http.StatusInternalServerError, ErrorResp{Error: err.Error()})
 	}
-	body := []byte(message.MIME.Parts[pid].Body)
-	if strings.ToLower(contentTransferEncoding) == "base64" {
-		var e error
-		body, e = base64.StdEncoding.DecodeString(message.MIME.Parts[pid].Body)
-		if e != nil {
-			log.Printf("[APIv1] Decoding base64 encoded body failed: %s", e)
+
+	part, err := tree.Find(path)
+	if err != nil {
+		return ctx.JSON(http.StatusNotFound, ErrorResp{Error: err.Error()})
+	}
+
+	body, err := part.Decode()
+	if err != nil {
+		log.Printf("[APIv1] Decoding %s encoded body failed: %s", part.Header.Get("Content-Transfer-Encoding"), err)
+		body = part.Body
+	}
+
+	contentType := part.ContentType
+	if part.IsText() {
+		if text, err := part.Text(); err == nil {
+			body = []byte(text)
+			contentType += "; charset=utf-8"
+		} else {
+			log.Printf("[APIv1] Converting charset %s failed: %s", part.Params["charset"], err)
 		}
 	}
 
-	_, _ = ctx.Response().Write(body)
-	return nil
+	disposition := part.Header.Get("Content-Disposition")
+	if len(disposition) == 0 {
+		disposition = "attachment; filename=\"" + id + "-part-" + path + "\""
+	}
+	ctx.Response().Header().Set("Content-Disposition", disposition)
+
+	return ctx.Blob(http.StatusOK, contentType, body)
 }
 
 func (v1 *APIv1) deleteAll(ctx echo.Context) error {
@@ -261,6 +275,10 @@ func (v1 *APIv1) deleteAll(ctx echo.Context) error {
 	if err != nil {
 		return ctx.JSON(http.StatusInternalServerError, ErrorResp{Error: err.Error()})
 	}
+	if err := v1.config.Metadata.DeleteAll(tenant); err != nil {
+		log.Printf("Error deleting metadata: %s", err)
+	}
+	v1.config.Webhooks.Notify(webhooks.Event{Type: webhooks.Deleted, Tenant: tenant})
 
 	return ctx.JSON(http.StatusOK, nil)
 }
@@ -280,72 +298,52 @@ func (v1 *APIv1) releaseOne(ctx echo.Context) error {
 	}
 
 	var cfg ReleaseConfig
-	if err = json.NewDecoder(ctx.Request().Body).Decode(&cfg); err != nil {
+	if err := json.NewDecoder(ctx.Request().Body).Decode(&cfg); err != nil {
 		return ctx.JSON(http.StatusInternalServerError, ErrorResp{Error: err.Error()})
 	}
 	defer ctx.Request().Body.Close()
 
+	if err := cfg.OutgoingSMTP.CheckInput(nil); err != nil {
+		return ctx.JSON(http.StatusBadRequest, ErrorResp{Error: err.Error()})
+	}
+	if err := cfg.Options.Validate(); err != nil {
+		return ctx.JSON(http.StatusBadRequest, ErrorResp{Error: err.Error()})
+	}
+
 	if cfg.Save {
-		if _, ok := v1.config.OutgoingSMTP[cfg.Name]; ok {
-			ctx.Logger().Printf("Server already exists named %s", cfg.Name)
-			return ctx.JSON(http.StatusBadRequest, ErrorResp{Error: "Server already exists named " + cfg.Name})
+		server := cfg.OutgoingSMTP
+		if err := v1.config.OutgoingServers.Add(tenant, &server); err != nil {
+			ctx.Logger().Printf("Failed to save server %s: %s", cfg.Name, err)
+			return ctx.JSON(http.StatusBadRequest, ErrorResp{Error: err.Error()})
 		}
-
-		cf := config.OutgoingSMTP(cfg)
-		v1.config.OutgoingSMTP[cfg.Name] = &cf
 		ctx.Logger().Printf("Saved server with name %s", cfg.Name)
 	}
 
 	if len(cfg.Name) > 0 {
-		if c, ok := v1.config.OutgoingSMTP[cfg.Name]; ok {
-			ctx.Logger().Printf("Using server with name: %s", cfg.Name)
-			cfg.Name = c.Name
-			if len(cfg.Email) == 0 {
-				cfg.Email = c.Email
-			}
-			cfg.Host = c.Host
-			cfg.Port = c.Port
-			cfg.Username = c.Username
-			cfg.Password = c.Password
-			cfg.Mechanism = c.Mechanism
-		} else {
+		c, ok := v1.config.OutgoingServers.Get(tenant, cfg.Name)
+		if !ok {
 			ctx.Logger().Printf("Server not found: %s", cfg.Name)
 			return ctx.JSON(http.StatusBadRequest, nil)
 		}
-	}
-
-	ctx.Logger().Printf("Releasing to %s (via %s:%s)", cfg.Email, cfg.Host, cfg.Port)
-
-	bytes := make([]byte, 0)
-	for h, l := range msg.Content.Headers {
-		for _, v := range l {
-			bytes = append(bytes, []byte(h+": "+v+"\r\n")...)
+		ctx.Logger().Printf("Using server with name: %s", cfg.Name)
+		if len(cfg.Email) > 0 {
+			c.Email = cfg.Email
 		}
+		cfg.OutgoingSMTP = *c
 	}
-	bytes = append(bytes, []byte("\r\n"+msg.Content.Body)...)
 
-	var auth smtp.Auth
+	server := cfg.OutgoingSMTP
+	rel := release.NewRelease(tenant, id, msg, &server, cfg.Options, v1.config.Hostname)
 
-	if len(cfg.Username) > 0 || len(cfg.Password) > 0 {
-		log.Printf("Found username/password, using auth mechanism: [%s]", cfg.Mechanism)
-		switch cfg.Mechanism {
-		case "CRAMMD5":
-			auth = smtp.CRAMMD5Auth(cfg.Username, cfg.Password)
-		case "PLAIN":
-			auth = smtp.PlainAuth("", cfg.Username, cfg.Password, cfg.Host)
-		default:
-			log.Printf("Error - invalid authentication mechanism")
-			return ctx.JSON(http.StatusBadRequest, nil)
-		}
-	}
+	ctx.Logger().Printf("Releasing to %v (via %s:%s)", rel.To, cfg.Host, cfg.Port)
 
-	err = smtp.SendMail(cfg.Host+":"+cfg.Port, auth, "nobody@"+v1.config.Hostname, []string{cfg.Email}, bytes)
+	r, err := v1.config.Releases.Enqueue(rel)
 	if err != nil {
-		log.Printf("Failed to release message: %s", err)
-		return ctx.JSON(http.StatusInternalServerError, nil)
+		log.Printf("Failed to queue release: %s", err)
+		return ctx.JSON(http.StatusBadRequest, ErrorResp{Error: err.Error()})
 	}
-	log.Printf("Message released successfully")
-	return nil
+
+	return ctx.JSON(http.StatusAccepted, r.Redacted())
 }
 
 func (v1 *APIv1) deleteOne(ctx echo.Context) error {
@@ -357,11 +355,18 @@ func (v1 *APIv1) deleteOne(ctx echo.Context) error {
 		})
 	}
 
+	// the message is loaded first so that webhook filters can match it
+	msg, _ := v1.config.Storage.Load(id, tenant)
+
 	err := v1.config.Storage.DeleteOne(id, tenant)
 	if err != nil {
 		ctx.Logger().Print(err.Error())
 		return ctx.JSON(http.StatusInternalServerError, ErrorResp{Error: err.Error()})
 	}
+	if err := v1.config.Metadata.Delete(tenant, id); err != nil {
+		log.Printf("Error deleting metadata: %s", err)
+	}
+	v1.config.Webhooks.Notify(webhooks.Event{Type: webhooks.Deleted, Tenant: tenant, MessageID: id, Message: msg})
 
 	return ctx.JSON(http.StatusOK, nil)
 }
@@ -4,11 +4,14 @@ import (
 	"net/http"
 	"net/url"
 	"strconv"
+	"sync"
 
 	"github.com/labstack/echo/v4"
 
 	"github.com/ian-kent/go-log/log"
+	"github.com/jay-dee7/MailHog-Server/codes"
 	"github.com/jay-dee7/MailHog-Server/config"
+	"github.com/jay-dee7/MailHog-Server/release"
 	"github.com/mailhog/MailHog-Server/websockets"
 	"github.com/mailhog/data"
 )
@@ -20,7 +23,9 @@ import (
 type APIv2 struct {
 	config      *config.Config
 	messageChan chan *data.Message
-	wsHub       *websockets.Hub
+	wsMu        sync.Mutex
+	wsHubs      map[string]*websockets.Hub
+	codeRules   *codes.Store
 }
 
 type ErrorResp struct {
@@ -31,16 +36,71 @@ func createAPIv2(conf *config.Config, group *echo.Group) *APIv2 {
 	v2 := &APIv2{
 		config:      conf,
 		messageChan: make(chan *data.Message),
-		wsHub:       websockets.NewHub(),
+		wsHubs:      make(map[string]*websockets.Hub),
+		codeRules:   codes.NewStore(),
 	}
 
 	// v1Group := group.Group(conf.WebPath + "/api/v2")
 
 	group.Add(http.MethodGet, conf.WebPath+"/api/v2/messages", v2.messages)
+	group.Add(http.MethodGet, conf.WebPath+"/api/v2/messages/:id/mime", v2.mime)
+	group.Add(http.MethodGet, conf.WebPath+"/api/v2/messages/:id/preview", v2.preview)
+	group.Add(http.MethodGet, conf.WebPath+"/api/v2/messages/:id/links", v2.links)
+	group.Add(http.MethodGet, conf.WebPath+"/api/v2/messages/:id/releases", v2.releases)
+	group.Add(http.MethodGet, conf.WebPath+"/api/v2/messages/:id/meta", v2.getMeta)
+	group.Add(http.MethodPatch, conf.WebPath+"/api/v2/messages/:id/meta", v2.updateMeta)
+	group.Add(http.MethodGet, conf.WebPath+"/api/v2/messages/:id/auth", v2.auth)
+	group.Add(http.MethodGet, conf.WebPath+"/api/v2/messages/:id/session", v2.session)
+	group.Add(http.MethodGet, conf.WebPath+"/api/v2/messages/:id/transcript", v2.messageTranscript)
+	group.Add(http.MethodGet, conf.WebPath+"/api/v2/messages/:id/proxy", v2.proxy)
+	group.Add(http.MethodGet, conf.WebPath+"/api/v2/threads", v2.listThreads)
+	group.Add(http.MethodGet, conf.WebPath+"/api/v2/threads/:id", v2.thread)
+	group.Add(http.MethodGet, conf.WebPath+"/api/v2/diff", v2.diff)
 	group.Add(http.MethodGet, conf.WebPath+"/api/v2/search", v2.search)
+	group.Add(http.MethodGet, conf.WebPath+"/api/v2/unread", v2.unread)
+	group.Add(http.MethodGet, conf.WebPath+"/api/v2/codes", v2.codes)
+	group.Add(http.MethodGet, conf.WebPath+"/api/v2/codes/rules", v2.listCodeRules)
+	group.Add(http.MethodPut, conf.WebPath+"/api/v2/codes/rules/:name", v2.putCodeRule)
+	group.Add(http.MethodDelete, conf.WebPath+"/api/v2/codes/rules/:name", v2.deleteCodeRule)
 	group.Add(http.MethodGet, conf.WebPath+"/api/v2/outgoing-smtp", v2.listOutgoingSMTP)
+	group.Add(http.MethodGet, conf.WebPath+"/api/v2/outgoing-smtp/:name", v2.getOutgoingSMTP)
+	group.Add(http.MethodPut, conf.WebPath+"/api/v2/outgoing-smtp/:name", v2.putOutgoingSMTP)
+	group.Add(http.MethodDelete, conf.WebPath+"/api/v2/outgoing-smtp/:name", v2.deleteOutgoingSMTP)
+	group.Add(http.MethodPost, conf.WebPath+"/api/v2/outgoing-smtp/:name/test", v2.testOutgoingSMTP)
+	group.Add(http.MethodGet, conf.WebPath+"/api/v2/auto-release", v2.listAutoReleaseRules)
+	group.Add(http.MethodPut, conf.WebPath+"/api/v2/auto-release/:name", v2.putAutoReleaseRule)
+	group.Add(http.MethodDelete, conf.WebPath+"/api/v2/auto-release/:name", v2.deleteAutoReleaseRule)
+	group.Add(http.MethodGet, conf.WebPath+"/api/v2/webhooks", v2.listWebhooks)
+	group.Add(http.MethodPut, conf.WebPath+"/api/v2/webhooks/:name", v2.putWebhook)
+	group.Add(http.MethodDelete, conf.WebPath+"/api/v2/webhooks/:name", v2.deleteWebhook)
+	group.Add(http.MethodGet, conf.WebPath+"/api/v2/rules", v2.listRules)
+	group.Add(http.MethodPut, conf.WebPath+"/api/v2/rules/:name", v2.putRule)
+	group.Add(http.MethodDelete, conf.WebPath+"/api/v2/rules/:name", v2.deleteRule)
+	group.Add(http.MethodGet, conf.WebPath+"/api/v2/jim", v2.getJim)
+	group.Add(http.MethodPut, conf.WebPath+"/api/v2/jim", v2.putJim)
+	group.Add(http.MethodDelete, conf.WebPath+"/api/v2/jim", v2.resetJim)
+	group.Add(http.MethodGet, conf.WebPath+"/api/v2/scenarios", v2.listScenarios)
+	group.Add(http.MethodPut, conf.WebPath+"/api/v2/scenarios/:name", v2.putScenario)
+	group.Add(http.MethodDelete, conf.WebPath+"/api/v2/scenarios/:name", v2.deleteScenario)
+	group.Add(http.MethodPost, conf.WebPath+"/api/v2/scenarios/:name/reset", v2.resetScenario)
+	group.Add(http.MethodGet, conf.WebPath+"/api/v2/greylist", v2.listGreylist)
+	group.Add(http.MethodDelete, conf.WebPath+"/api/v2/greylist", v2.resetGreylist)
+	group.Add(http.MethodGet, conf.WebPath+"/api/v2/transcripts", v2.listTranscripts)
+	group.Add(http.MethodGet, conf.WebPath+"/api/v2/transcripts/:id", v2.getTranscript)
+	group.Add(http.MethodGet, conf.WebPath+"/api/v2/snapshots", v2.listSnapshots)
+	group.Add(http.MethodGet, conf.WebPath+"/api/v2/snapshots/:name", v2.getSnapshot)
+	group.Add(http.MethodPut, conf.WebPath+"/api/v2/snapshots/:name", v2.putSnapshot)
+	group.Add(http.MethodDelete, conf.WebPath+"/api/v2/snapshots/:name", v2.deleteSnapshot)
+	group.Add(http.MethodGet, conf.WebPath+"/api/v2/snapshots/:name/compare/:id", v2.compareSnapshot)
 	group.Add(http.MethodGet, conf.WebPath+"/api/v2/websocket", v2.websocket)
 
+	conf.Metadata.Subscribe(func(tenant string) {
+		v2.hub(tenant).Broadcast(event{Type: "unread", Tenant: tenant, Data: echo.Map{"unread": v2.unreadCount(tenant)}})
+	})
+	conf.Releases.Subscribe(func(r release.Release) {
+		v2.hub(r.Tenant).Broadcast(event{Type: "release", Tenant: r.Tenant, Data: r.Redacted()})
+	})
+
 	go func() {
 		for {
 			select {
@@ -54,11 +114,18 @@ func createAPIv2(conf *config.Config, group *echo.Group) *APIv2 {
 	return v2
 }
 
+// event is sent to websocket clients for anything other than new messages
+type event struct {
+	Type   string      `json:"type"`
+	Tenant string      `json:"tenant"`
+	Data   interface{} `json:"data"`
+}
+
 type messagesResult struct {
-	Total int            `json:"total"`
-	Count int            `json:"count"`
-	Start int            `json:"start"`
-	Items []data.Message `json:"items"`
+	Total int           `json:"total"`
+	Count int           `json:"count"`
+	Start int           `json:"start"`
+	Items []messageItem `json:"items"`
 }
 
 func (v2 *APIv2) getStartLimit(q url.Values) (start, limit int) {
@@ -101,7 +168,7 @@ func (v2 *APIv2) messages(ctx echo.Context) error {
 		Total: v2.config.Storage.Count(tenant),
 		Count: len(*messages),
 		Start: start,
-		Items: *messages,
+		Items: v2.withMeta(tenant, messages),
 	}
 
 	return ctx.JSON(http.StatusOK, res)
@@ -126,7 +193,7 @@ func (v2 *APIv2) search(ctx echo.Context) error {
 		})
 	}
 
-	messages, total, err := v2.config.Storage.Search(kind, query, start, limit, tenant)
+	messages, total, err := v2.searchMessages(kind, query, start, limit, tenant)
 	if err != nil {
 		return ctx.JSON(http.StatusInternalServerError, ErrorResp{
 			Error: err.Error(),
@@ -138,21 +205,82 @@ func (v2 *APIv2) search(ctx echo.Context) error {
 		Total: total,
 		Count: len(*messages),
 		Start: start,
-		Items: *messages,
+		Items: v2.withMeta(tenant, messages),
 	}
 
 	return ctx.JSON(http.StatusOK, resp)
 }
 
-func (v2 *APIv2) listOutgoingSMTP(ctx echo.Context) error {
-	return ctx.JSON(http.StatusOK, v2.config.OutgoingSMTP)
+// searchMessages extends the storage search with the kinds which
+// are evaluated by the API
+func (v2 *APIv2) searchMessages(kind, query string, start, limit int, tenant string) (*data.Messages, int, error) {
+	if k, q, ok := qualifier(query); ok {
+		kind, query = k, q
+	}
+
+	switch kind {
+	case "tag", "label", "is":
+		return v2.searchMeta(kind, query, start, limit, tenant)
+	case "attachment":
+		return v2.searchAttachments(query, start, limit, tenant)
+	default:
+		return v2.config.Storage.Search(kind, query, start, limit, tenant)
+	}
+}
+
+func (v2 *APIv2) releases(ctx echo.Context) error {
+	tenant, ok := ctx.Get("tenant").(string)
+	if !ok {
+		return ctx.JSON(http.StatusPreconditionRequired, echo.Map{
+			"error": "missing tenant id in request context",
+		})
+	}
+
+	history := v2.config.Releases.History(tenant, ctx.Param("id"))
+	for i := range history {
+		history[i] = history[i].Redacted()
+	}
+
+	return ctx.JSON(http.StatusOK, history)
+}
+
+// hub returns the websocket hub of the tenant, so that events only reach
+// the clients of the tenant they belong to
+func (v2 *APIv2) hub(tenant string) *websockets.Hub {
+	v2.wsMu.Lock()
+	defer v2.wsMu.Unlock()
+
+	h, ok := v2.wsHubs[tenant]
+	if !ok {
+		h = websockets.NewHub()
+		v2.wsHubs[tenant] = h
+	}
+	return h
 }
 
 func (v2 *APIv2) websocket(ctx echo.Context) error {
-	v2.wsHub.Serve(ctx.Response(), ctx.Request())
+	tenant, ok := ctx.Get("tenant").(string)
+	if !ok {
+		return ctx.JSON(http.StatusPreconditionRequired, echo.Map{
+			"error": "missing tenant id in request context",
+		})
+	}
+
+	v2.hub(tenant).Serve(ctx.Response(), ctx.Request())
 	return nil
 }
 
+// broadcast sends a new message to the websocket clients. Messages sent on
+// MessageChan don't carry their tenant, so every hub receives them.
 func (v2 *APIv2) broadcast(msg *data.Message) {
-	v2.wsHub.Broadcast(msg)
+	v2.wsMu.Lock()
+	hubs := make([]*websockets.Hub, 0, len(v2.wsHubs))
+	for _, h := range v2.wsHubs {
+		hubs = append(hubs, h)
+	}
+	v2.wsMu.Unlock()
+
+	for _, h := range hubs {
+		h.Broadcast(msg)
+	}
 }
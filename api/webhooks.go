@@ -0,0 +1,72 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/jay-dee7/MailHog-Server/webhooks"
+	"github.com/labstack/echo/v4"
+)
+
+func (v2 *APIv2) listWebhooks(ctx echo.Context) error {
+	tenant, ok := ctx.Get("tenant").(string)
+	if !ok {
+		return ctx.JSON(http.StatusPreconditionRequired, echo.Map{
+			"error": "missing tenant id in request context",
+		})
+	}
+
+	hooks := v2.config.Webhooks.List(tenant)
+	for i, h := range hooks {
+		hooks[i] = h.Redacted()
+	}
+
+	return ctx.JSON(http.StatusOK, hooks)
+}
+
+func (v2 *APIv2) putWebhook(ctx echo.Context) error {
+	tenant, ok := ctx.Get("tenant").(string)
+	if !ok {
+		return ctx.JSON(http.StatusPreconditionRequired, echo.Map{
+			"error": "missing tenant id in request context",
+		})
+	}
+
+	var hook webhooks.Webhook
+	if err := json.NewDecoder(ctx.Request().Body).Decode(&hook); err != nil {
+		return ctx.JSON(http.StatusBadRequest, ErrorResp{Error: err.Error()})
+	}
+	hook.Name = ctx.Param("name")
+
+	// secrets are never returned, so an update without one keeps the old one
+	if len(hook.Secret) == 0 {
+		if old, ok := v2.config.Webhooks.Get(tenant, hook.Name); ok {
+			hook.Secret = old.Secret
+		}
+	}
+
+	if err := v2.config.Webhooks.Put(tenant, hook); err != nil {
+		return ctx.JSON(http.StatusBadRequest, ErrorResp{Error: err.Error()})
+	}
+
+	return ctx.JSON(http.StatusOK, hook.Redacted())
+}
+
+func (v2 *APIv2) deleteWebhook(ctx echo.Context) error {
+	tenant, ok := ctx.Get("tenant").(string)
+	if !ok {
+		return ctx.JSON(http.StatusPreconditionRequired, echo.Map{
+			"error": "missing tenant id in request context",
+		})
+	}
+
+	err := v2.config.Webhooks.Delete(tenant, ctx.Param("name"))
+	switch {
+	case err == webhooks.ErrWebhookNotFound:
+		return ctx.JSON(http.StatusNotFound, ErrorResp{Error: err.Error()})
+	case err != nil:
+		return ctx.JSON(http.StatusInternalServerError, ErrorResp{Error: err.Error()})
+	}
+
+	return ctx.JSON(http.StatusOK, nil)
+}
@@ -0,0 +1,141 @@
+// Package chaos holds the settings of the Jim chaos monkey for each tenant,
+// which can be changed while running.
+package chaos
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/mailhog/MailHog-Server/monkey"
+)
+
+// Settings enable Jim for a tenant and set his probabilities
+type Settings struct {
+	Enabled          bool    `json:"enabled"`
+	AcceptChance     float64 `json:"acceptChance"`
+	DisconnectChance float64 `json:"disconnectChance"`
+	// LinkSpeedAffect is the chance of limiting the throughput of a session
+	// to between LinkSpeedMin and LinkSpeedMax bytes per second
+	LinkSpeedAffect       float64 `json:"linkSpeedAffect"`
+	LinkSpeedMin          float64 `json:"linkSpeedMin"`
+	LinkSpeedMax          float64 `json:"linkSpeedMax"`
+	RejectSenderChance    float64 `json:"rejectSenderChance"`
+	RejectRecipientChance float64 `json:"rejectRecipientChance"`
+	RejectAuthChance      float64 `json:"rejectAuthChance"`
+	// Default is set if the tenant uses the default settings
+	Default bool `json:"default"`
+}
+
+// Validate checks the probabilities are between 0 and 1 and the link speeds
+// are positive
+func (s *Settings) Validate() error {
+	for _, p := range []float64{s.AcceptChance, s.DisconnectChance, s.LinkSpeedAffect, s.RejectSenderChance, s.RejectRecipientChance, s.RejectAuthChance} {
+		if p < 0 || p > 1 {
+			return errors.New("chances must be between 0 and 1")
+		}
+	}
+	if s.LinkSpeedMin <= 0 || s.LinkSpeedMax < s.LinkSpeedMin {
+		return errors.New("link speeds must be positive, and the maximum at least the minimum")
+	}
+	return nil
+}
+
+func settingsOf(j *monkey.Jim, enabled bool) Settings {
+	return Settings{
+		Enabled:               enabled,
+		AcceptChance:          j.AcceptChance,
+		DisconnectChance:      j.DisconnectChance,
+		LinkSpeedAffect:       j.LinkSpeedAffect,
+		LinkSpeedMin:          j.LinkSpeedMin,
+		LinkSpeedMax:          j.LinkSpeedMax,
+		RejectSenderChance:    j.RejectSenderChance,
+		RejectRecipientChance: j.RejectRecipientChance,
+		RejectAuthChance:      j.RejectAuthChance,
+	}
+}
+
+// Store holds the default Jim and the Jims of tenants with their own settings
+type Store struct {
+	mu       sync.RWMutex
+	defaults *monkey.Jim
+	enabled  bool
+	tenants  map[string]*monkey.Jim
+	disabled map[string]bool
+}
+
+// NewStore creates a store using jim, which must be configured, for tenants
+// without their own settings
+func NewStore(jim *monkey.Jim, enabled bool) *Store {
+	return &Store{
+		defaults: jim,
+		enabled:  enabled,
+		tenants:  make(map[string]*monkey.Jim),
+		disabled: make(map[string]bool),
+	}
+}
+
+// Get returns the settings of the tenant
+func (s *Store) Get(tenant string) Settings {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if j, ok := s.tenants[tenant]; ok {
+		return settingsOf(j, !s.disabled[tenant])
+	}
+	settings := settingsOf(s.defaults, s.enabled)
+	settings.Default = true
+	return settings
+}
+
+// Put validates and sets the settings of the tenant
+func (s *Store) Put(tenant string, settings Settings) error {
+	if err := settings.Validate(); err != nil {
+		return err
+	}
+
+	j := &monkey.Jim{
+		AcceptChance:          settings.AcceptChance,
+		DisconnectChance:      settings.DisconnectChance,
+		LinkSpeedAffect:       settings.LinkSpeedAffect,
+		LinkSpeedMin:          settings.LinkSpeedMin,
+		LinkSpeedMax:          settings.LinkSpeedMax,
+		RejectSenderChance:    settings.RejectSenderChance,
+		RejectRecipientChance: settings.RejectRecipientChance,
+		RejectAuthChance:      settings.RejectAuthChance,
+	}
+	j.ConfigureFrom(s.defaults)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.tenants[tenant] = j
+	s.disabled[tenant] = !settings.Enabled
+	return nil
+}
+
+// Reset returns the tenant to the default settings
+func (s *Store) Reset(tenant string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.tenants, tenant)
+	delete(s.disabled, tenant)
+}
+
+// Monkey returns the chaos monkey for a new session of the tenant, or nil
+// if Jim isn't enabled for it
+func (s *Store) Monkey(tenant string) monkey.ChaosMonkey {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if j, ok := s.tenants[tenant]; ok {
+		if s.disabled[tenant] {
+			return nil
+		}
+		return j
+	}
+	if !s.enabled {
+		return nil
+	}
+	return s.defaults
+}
@@ -0,0 +1,35 @@
+package chaos
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/mailhog/MailHog-Server/monkey"
+)
+
+func TestStore(t *testing.T) {
+	Convey("Tenants should use the default Jim until they have their own settings", t, func() {
+		jim := &monkey.Jim{AcceptChance: 0.99, LinkSpeedMin: 1024, LinkSpeedMax: 10240}
+		jim.Configure(func(string, ...interface{}) {})
+		s := NewStore(jim, false)
+
+		So(s.Monkey("a"), ShouldBeNil)
+		So(s.Get("a").Default, ShouldBeTrue)
+
+		settings := s.Get("a")
+		settings.Enabled = true
+		settings.RejectRecipientChance = 1
+		So(s.Put("a", settings), ShouldBeNil)
+		So(s.Get("a").Default, ShouldBeFalse)
+		So(s.Get("a").RejectRecipientChance, ShouldEqual, 1.0)
+		So(s.Monkey("a").ValidRCPT("b@mailhog.example"), ShouldBeFalse)
+		So(s.Monkey("b"), ShouldBeNil)
+
+		settings.AcceptChance = 2
+		So(s.Put("a", settings), ShouldNotBeNil)
+
+		s.Reset("a")
+		So(s.Monkey("a"), ShouldBeNil)
+	})
+}
@@ -0,0 +1,135 @@
+// Package codes extracts one-time passwords and verification codes from
+// message text using regular expression rules.
+package codes
+
+import (
+	"errors"
+	"regexp"
+	"sort"
+	"sync"
+)
+
+// ErrInvalidRule is returned when a rule has no name or pattern
+var ErrInvalidRule = errors.New("rule requires a name and a pattern")
+
+// Rule is a named regular expression used to extract codes.
+//
+// Named capture groups are returned by name. A pattern without
+// named groups returns the whole match as "code".
+type Rule struct {
+	Name    string `json:"name"`
+	Pattern string `json:"pattern"`
+	Preset  bool   `json:"preset,omitempty"`
+
+	re *regexp.Regexp
+}
+
+// NewRule compiles a rule
+func NewRule(name, pattern string) (*Rule, error) {
+	if len(name) == 0 || len(pattern) == 0 {
+		return nil, ErrInvalidRule
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return &Rule{Name: name, Pattern: pattern, re: re}, nil
+}
+
+func preset(name, pattern string) *Rule {
+	return &Rule{Name: name, Pattern: pattern, Preset: true, re: regexp.MustCompile(pattern)}
+}
+
+// Presets are the rules available to every tenant
+var Presets = map[string]*Rule{
+	"numeric":      preset("numeric", `\b(?P<code>[0-9]{6})\b`),
+	"numeric-any":  preset("numeric-any", `\b(?P<code>[0-9]{4,8})\b`),
+	"alphanumeric": preset("alphanumeric", `\b(?P<code>(?:[A-Z]+[0-9]|[0-9]+[A-Z])[A-Z0-9]*)\b`),
+}
+
+// Extract returns the values captured by each match of the rule in text
+func (r *Rule) Extract(text string) []map[string]string {
+	names := r.re.SubexpNames()
+	var values []map[string]string
+	for _, m := range r.re.FindAllStringSubmatch(text, -1) {
+		v := make(map[string]string)
+		for i, name := range names {
+			if i > 0 && len(name) > 0 {
+				v[name] = m[i]
+			}
+		}
+		if len(v) == 0 {
+			v["code"] = m[0]
+		}
+		values = append(values, v)
+	}
+	return values
+}
+
+// Store holds the extraction rules defined by each tenant
+type Store struct {
+	mu    sync.RWMutex
+	rules map[string]map[string]*Rule
+}
+
+// NewStore creates an empty rule store
+func NewStore() *Store {
+	return &Store{rules: make(map[string]map[string]*Rule)}
+}
+
+// Get returns the named rule of the tenant, falling back to the presets
+func (s *Store) Get(tenant, name string) (*Rule, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if r, ok := s.rules[tenant][name]; ok {
+		return r, true
+	}
+	r, ok := Presets[name]
+	return r, ok
+}
+
+// List returns the presets and the rules of the tenant, sorted by name.
+// Tenant rules shadow presets of the same name.
+func (s *Store) List(tenant string) []*Rule {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	byName := make(map[string]*Rule)
+	for n, r := range Presets {
+		byName[n] = r
+	}
+	for n, r := range s.rules[tenant] {
+		byName[n] = r
+	}
+
+	rules := make([]*Rule, 0, len(byName))
+	for _, r := range byName {
+		rules = append(rules, r)
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].Name < rules[j].Name })
+	return rules
+}
+
+// Set adds or replaces a rule of the tenant
+func (s *Store) Set(tenant string, r *Rule) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.rules[tenant]; !ok {
+		s.rules[tenant] = make(map[string]*Rule)
+	}
+	s.rules[tenant][r.Name] = r
+}
+
+// Delete removes a rule of the tenant, returning false if it didn't exist
+func (s *Store) Delete(tenant, name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.rules[tenant][name]; !ok {
+		return false
+	}
+	delete(s.rules[tenant], name)
+	return true
+}
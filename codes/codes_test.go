@@ -0,0 +1,58 @@
+package codes
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestPresets(t *testing.T) {
+	Convey("numeric should extract six digit codes", t, func() {
+		values := Presets["numeric"].Extract("Your code is 123456, valid until 2024")
+		So(values, ShouldResemble, []map[string]string{{"code": "123456"}})
+	})
+
+	Convey("alphanumeric should only extract mixed codes", t, func() {
+		values := Presets["alphanumeric"].Extract("ACCOUNT code X7K2QP and 9ZZ")
+		So(values, ShouldResemble, []map[string]string{{"code": "X7K2QP"}, {"code": "9ZZ"}})
+	})
+}
+
+func TestRule(t *testing.T) {
+	Convey("Extract should return named groups", t, func() {
+		r, err := NewRule("link", `token=(?P<token>[a-z]+)&user=(?P<user>[0-9]+)`)
+		So(err, ShouldBeNil)
+		So(r.Extract("https://x/?token=abc&user=42"), ShouldResemble, []map[string]string{{"token": "abc", "user": "42"}})
+	})
+
+	Convey("Extract should return the whole match without named groups", t, func() {
+		r, _ := NewRule("plain", `[0-9]+`)
+		So(r.Extract("a 1 b"), ShouldResemble, []map[string]string{{"code": "1"}})
+	})
+
+	Convey("NewRule should reject invalid rules", t, func() {
+		_, err := NewRule("", "x")
+		So(err, ShouldEqual, ErrInvalidRule)
+		_, err = NewRule("bad", "(")
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestStore(t *testing.T) {
+	Convey("Store should scope rules by tenant and fall back to presets", t, func() {
+		s := NewStore()
+		r, _ := NewRule("numeric", `[0-9]{4}`)
+		s.Set("a", r)
+
+		got, ok := s.Get("a", "numeric")
+		So(ok, ShouldBeTrue)
+		So(got, ShouldEqual, r)
+
+		got, ok = s.Get("b", "numeric")
+		So(ok, ShouldBeTrue)
+		So(got, ShouldEqual, Presets["numeric"])
+
+		So(s.Delete("a", "numeric"), ShouldBeTrue)
+		So(s.Delete("a", "numeric"), ShouldBeFalse)
+	})
+}
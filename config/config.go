@@ -1,13 +1,23 @@
 package config
 
 import (
-	"encoding/json"
 	"flag"
 	"github.com/mailhog/MailHog-Server/monkey"
-	"io/ioutil"
 	"log"
+	"time"
 
 	"github.com/ian-kent/envconf"
+	"github.com/jay-dee7/MailHog-Server/chaos"
+	"github.com/jay-dee7/MailHog-Server/greylist"
+	"github.com/jay-dee7/MailHog-Server/metadata"
+	"github.com/jay-dee7/MailHog-Server/msgauth"
+	"github.com/jay-dee7/MailHog-Server/msgdiff"
+	"github.com/jay-dee7/MailHog-Server/release"
+	"github.com/jay-dee7/MailHog-Server/retention"
+	"github.com/jay-dee7/MailHog-Server/rules"
+	"github.com/jay-dee7/MailHog-Server/scenario"
+	"github.com/jay-dee7/MailHog-Server/transcript"
+	"github.com/jay-dee7/MailHog-Server/webhooks"
 	"github.com/jay-dee7/storage"
 	"github.com/mailhog/data"
 )
@@ -26,7 +36,6 @@ func DefaultConfig() *Config {
 		CORSOrigin:   "",
 		WebPath:      "",
 		MessageChan:  make(chan *data.Message),
-		OutgoingSMTP: make(map[string]*OutgoingSMTP),
 	}
 }
 
@@ -46,26 +55,45 @@ type Config struct {
 	MessageChan      chan *data.Message
 	Assets           func(asset string) ([]byte, error)
 	OutgoingSMTPFile string
-	OutgoingSMTP     map[string]*OutgoingSMTP
+	OutgoingServers  *release.ServerStore
+	SecretKey        string
+	AutoReleaseFile  string
+	AutoReleases     *release.RuleStore
+	WebhooksFile     string
+	Webhooks         *webhooks.Dispatcher
+	RulesFile        string
+	RouteTenants     string
+	Rules            *rules.Engine
+	MetadataFile     string
+	Metadata         *metadata.Store
+	VerifyAuth       bool
+	AuthZoneFile     string
+	Authentication   *msgauth.Verifier
+	Scenarios        *scenario.Store
+	TranscriptLimit  int
+	Transcripts      *transcript.Store
+	SnapshotsFile    string
+	Snapshots        *msgdiff.Store
+	GreylistDelay    string
+	Greylist         *greylist.List
+	RetentionPeriod  string
+	Retention        *retention.Sweeper
+	ReleaseQueueFile string
+	Releases         *release.Queue
 	WebPath          string
 	InviteJim        bool
 	Monkey           monkey.ChaosMonkey
+	Chaos            *chaos.Store
 }
 
 // OutgoingSMTP is an outgoing SMTP server config
-type OutgoingSMTP struct {
-	Name      string
-	Save      bool
-	Email     string
-	Host      string
-	Port      string
-	Username  string
-	Password  string
-	Mechanism string
-}
+type OutgoingSMTP = release.Server
 
 var cfg = DefaultConfig()
 
+// jim is the default chaos monkey, configured by the jim-* flags
+var jim = &monkey.Jim{}
+
 // Configure configures stuff
 func Configure(multiTenant bool) *Config {
 
@@ -77,19 +105,92 @@ func Configure(multiTenant bool) *Config {
 		cfg.SimpleStorage = s
 	}
 
-	if len(cfg.OutgoingSMTPFile) > 0 {
-		b, err := ioutil.ReadFile(cfg.OutgoingSMTPFile)
+	cipher := release.NewCipher(cfg.SecretKey)
+	o, err := release.NewServerStore(cfg.OutgoingSMTPFile, cipher)
+	if err != nil {
+		log.Fatal(err)
+	}
+	cfg.OutgoingServers = o
+	cfg.Releases = release.NewQueue(cfg.Storage, cfg.ReleaseQueueFile, cipher, cfg.OutgoingServers)
+
+	r, err := release.NewRuleStore(cfg.AutoReleaseFile, cfg.OutgoingServers, cfg.Releases, cfg.Hostname)
+	if err != nil {
+		log.Fatal(err)
+	}
+	cfg.AutoReleases = r
+
+	w, err := webhooks.NewDispatcher(cfg.WebhooksFile, cipher)
+	if err != nil {
+		log.Fatal(err)
+	}
+	cfg.Webhooks = w
+
+	e, err := rules.NewEngine(cfg.RulesFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if e.Routes, err = rules.ParseRoutes(cfg.RouteTenants); err != nil {
+		log.Fatal(err)
+	}
+	cfg.Rules = e
+
+	m, err := metadata.NewStore(cfg.MetadataFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	cfg.Metadata = m
+
+	if cfg.VerifyAuth {
+		v, err := msgauth.NewVerifier(cfg.Hostname, cfg.AuthZoneFile)
 		if err != nil {
 			log.Fatal(err)
 		}
-		var o map[string]*OutgoingSMTP
-		err = json.Unmarshal(b, &o)
+		cfg.Authentication = v
+	}
+
+	cfg.Scenarios = scenario.NewStore()
+
+	jim.Configure(func(message string, args ...interface{}) {
+		log.Printf(message, args...)
+	})
+	cfg.Chaos = chaos.NewStore(jim, cfg.InviteJim)
+	if cfg.InviteJim {
+		cfg.Monkey = jim
+	}
+
+	if cfg.TranscriptLimit > 0 {
+		cfg.Transcripts = transcript.NewStore(cfg.TranscriptLimit)
+	}
+
+	sn, err := msgdiff.NewStore(cfg.SnapshotsFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	cfg.Snapshots = sn
+
+	if len(cfg.GreylistDelay) > 0 {
+		delay, err := time.ParseDuration(cfg.GreylistDelay)
 		if err != nil {
 			log.Fatal(err)
 		}
-		cfg.OutgoingSMTP = o
+		cfg.Greylist = greylist.New(delay)
 	}
 
+	var maxAge time.Duration
+	if len(cfg.RetentionPeriod) > 0 {
+		if maxAge, err = time.ParseDuration(cfg.RetentionPeriod); err != nil {
+			log.Fatal(err)
+		}
+	}
+	cfg.Retention = retention.NewSweeper(cfg.Storage, cfg.Metadata, cfg.Webhooks, maxAge)
+
+	cfg.Releases.Subscribe(func(r release.Release) {
+		if r.Status == release.Sent {
+			r = r.Redacted()
+			w.Notify(webhooks.Event{Type: webhooks.Released, Tenant: r.Tenant, MessageID: r.MessageID, Release: &r})
+		}
+	})
+
 	return cfg
 }
 
@@ -105,4 +206,19 @@ func RegisterFlags() {
 	flag.StringVar(&cfg.CORSOrigin, "cors-origin", envconf.FromEnvP("MH_CORS_ORIGIN", "").(string), "CORS Access-Control-Allow-Origin header for API endpoints")
 	flag.StringVar(&cfg.MaildirPath, "maildir-path", envconf.FromEnvP("MH_MAILDIR_PATH", "").(string), "Maildir path (if storage type is 'maildir')")
 	flag.StringVar(&cfg.OutgoingSMTPFile, "outgoing-smtp", envconf.FromEnvP("MH_OUTGOING_SMTP", "").(string), "JSON file containing outgoing SMTP servers")
+	flag.StringVar(&cfg.SecretKey, "secret-key", envconf.FromEnvP("MH_SECRET_KEY", "").(string), "Key to encrypt outgoing SMTP passwords stored in files, stored unencrypted if empty")
+	flag.StringVar(&cfg.AutoReleaseFile, "auto-release", envconf.FromEnvP("MH_AUTO_RELEASE", "").(string), "JSON file to persist auto-release rules to, kept in memory if empty")
+	flag.StringVar(&cfg.WebhooksFile, "webhooks", envconf.FromEnvP("MH_WEBHOOKS", "").(string), "JSON file to persist webhooks to, kept in memory if empty")
+	flag.StringVar(&cfg.RulesFile, "rules", envconf.FromEnvP("MH_RULES", "").(string), "JSON file to persist incoming mail rules to, reloaded when changed, kept in memory if empty")
+	flag.StringVar(&cfg.RouteTenants, "route-tenants", envconf.FromEnvP("MH_ROUTE_TENANTS", "").(string), "Comma separated source:target tenant pairs, allowing the rules of the source tenant to route messages to the target tenant, e.g. staging:qa. Routing is disabled if empty")
+	flag.StringVar(&cfg.MetadataFile, "metadata", envconf.FromEnvP("MH_METADATA", "mailhog-metadata.json").(string), "JSON file to persist message metadata such as tags and stars to, since the storage backend doesn't hold it. Kept in memory and lost on restart if empty")
+	flag.BoolVar(&cfg.VerifyAuth, "verify-auth", envconf.FromEnvP("MH_VERIFY_AUTH", false).(bool), "Verify the DKIM signatures, SPF and DMARC of accepted messages")
+	flag.StringVar(&cfg.AuthZoneFile, "auth-zone", envconf.FromEnvP("MH_AUTH_ZONE", "").(string), "Zone file to resolve DKIM keys, SPF and DMARC records from instead of DNS")
+	flag.IntVar(&cfg.TranscriptLimit, "transcripts", envconf.FromEnvP("MH_TRANSCRIPTS", 0).(int), "Number of SMTP session transcripts kept in memory per tenant, each using up to about 500KB. Disabled if 0")
+	flag.StringVar(&cfg.SnapshotsFile, "snapshots", envconf.FromEnvP("MH_SNAPSHOTS", "").(string), "JSON file to persist golden message snapshots to, kept in memory if empty")
+	flag.StringVar(&cfg.GreylistDelay, "greylist", envconf.FromEnvP("MH_GREYLIST", "").(string), "Greylist unseen IP, sender and recipient triplets, accepting retries after this duration, e.g. 5m. Disabled if empty")
+	flag.StringVar(&cfg.RetentionPeriod, "retention", envconf.FromEnvP("MH_RETENTION", "").(string), "Delete messages older than this duration, e.g. 168h, except starred messages. Messages are kept forever if empty")
+	flag.BoolVar(&cfg.InviteJim, "invite-jim", envconf.FromEnvP("MH_INVITE_JIM", false).(bool), "Decide whether to invite Jim (beware, he causes chaos), his settings can be changed per tenant through the API")
+	jim.RegisterFlags()
+	flag.StringVar(&cfg.ReleaseQueueFile, "release-queue", envconf.FromEnvP("MH_RELEASE_QUEUE", "").(string), "JSON file to persist the release queue to, kept in memory if empty")
 }
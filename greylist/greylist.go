@@ -0,0 +1,112 @@
+// Package greylist simulates greylisting: the first delivery attempt for an
+// unseen client IP, sender and recipient triplet is deferred, and retries
+// after a delay are accepted.
+package greylist
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultMaxAge is how long triplets are remembered after they were last seen
+const DefaultMaxAge = 24 * time.Hour
+
+// Triplet is a client IP, envelope sender and recipient seen by the greylist
+type Triplet struct {
+	IP        string    `json:"ip"`
+	Sender    string    `json:"sender"`
+	Recipient string    `json:"recipient"`
+	FirstSeen time.Time `json:"firstSeen"`
+	LastSeen  time.Time `json:"lastSeen"`
+	// Attempts counts the deliveries attempted, including accepted ones
+	Attempts int `json:"attempts"`
+	// Passed is set once a retry was accepted
+	Passed bool `json:"passed"`
+}
+
+// List holds the triplets of each tenant in memory
+type List struct {
+	// Delay is how long after the first attempt retries are accepted
+	Delay time.Duration
+	// MaxAge is how long triplets are remembered after they were last seen
+	MaxAge time.Duration
+
+	mu       sync.Mutex
+	triplets map[string]map[string]*Triplet
+	now      func() time.Time
+}
+
+// New creates a greylist accepting retries after delay
+func New(delay time.Duration) *List {
+	return &List{
+		Delay:    delay,
+		MaxAge:   DefaultMaxAge,
+		triplets: make(map[string]map[string]*Triplet),
+		now:      time.Now,
+	}
+}
+
+// Check records a delivery attempt, and returns true if it's accepted, or
+// false and how long the client must wait before retrying
+func (l *List) Check(tenant, ip, sender, recipient string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.expire(tenant, now)
+
+	sender, recipient = strings.ToLower(sender), strings.ToLower(recipient)
+	key := ip + "\x00" + sender + "\x00" + recipient
+	if _, ok := l.triplets[tenant]; !ok {
+		l.triplets[tenant] = make(map[string]*Triplet)
+	}
+	t, ok := l.triplets[tenant][key]
+	if !ok {
+		t = &Triplet{IP: ip, Sender: sender, Recipient: recipient, FirstSeen: now}
+		l.triplets[tenant][key] = t
+	}
+	t.Attempts++
+	t.LastSeen = now
+
+	if wait := t.FirstSeen.Add(l.Delay).Sub(now); !t.Passed && (!ok || wait > 0) {
+		if wait <= 0 {
+			wait = l.Delay
+		}
+		return false, wait
+	}
+	t.Passed = true
+	return true, 0
+}
+
+// expire forgets the triplets of the tenant which weren't seen for MaxAge,
+// the caller must hold l.mu
+func (l *List) expire(tenant string, now time.Time) {
+	for key, t := range l.triplets[tenant] {
+		if now.Sub(t.LastSeen) > l.MaxAge {
+			delete(l.triplets[tenant], key)
+		}
+	}
+}
+
+// List returns the triplets of the tenant, most recently seen first
+func (l *List) List(tenant string) []Triplet {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.expire(tenant, l.now())
+	triplets := []Triplet{}
+	for _, t := range l.triplets[tenant] {
+		triplets = append(triplets, *t)
+	}
+	sort.Slice(triplets, func(i, j int) bool { return triplets[i].LastSeen.After(triplets[j].LastSeen) })
+	return triplets
+}
+
+// Reset forgets the triplets of the tenant
+func (l *List) Reset(tenant string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.triplets, tenant)
+}
@@ -0,0 +1,46 @@
+package greylist
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCheck(t *testing.T) {
+	Convey("Retries of a triplet should be accepted after the delay", t, func() {
+		now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+		l := New(5 * time.Minute)
+		l.now = func() time.Time { return now }
+
+		ok, wait := l.Check("a", "10.0.0.1", "a@mailhog.example", "b@mailhog.example")
+		So(ok, ShouldBeFalse)
+		So(wait, ShouldEqual, 5*time.Minute)
+
+		now = now.Add(time.Minute)
+		ok, wait = l.Check("a", "10.0.0.1", "A@mailhog.example", "b@mailhog.example")
+		So(ok, ShouldBeFalse)
+		So(wait, ShouldEqual, 4*time.Minute)
+
+		ok, _ = l.Check("a", "10.0.0.2", "a@mailhog.example", "b@mailhog.example")
+		So(ok, ShouldBeFalse)
+		ok, _ = l.Check("b", "10.0.0.1", "a@mailhog.example", "b@mailhog.example")
+		So(ok, ShouldBeFalse)
+
+		now = now.Add(4 * time.Minute)
+		ok, _ = l.Check("a", "10.0.0.1", "a@mailhog.example", "b@mailhog.example")
+		So(ok, ShouldBeTrue)
+
+		triplets := l.List("a")
+		So(triplets, ShouldHaveLength, 2)
+		So(triplets[0].IP, ShouldEqual, "10.0.0.1")
+		So(triplets[0].Attempts, ShouldEqual, 3)
+		So(triplets[0].Passed, ShouldBeTrue)
+
+		l.Reset("b")
+		So(l.List("b"), ShouldBeEmpty)
+
+		now = now.Add(DefaultMaxAge + time.Second)
+		So(l.List("a"), ShouldBeEmpty)
+	})
+}
@@ -29,6 +29,10 @@ func main() {
 		http.AuthFile(comconf.AuthFile)
 	}
 
+	defer conf.Metadata.Flush()
+	conf.Releases.Start()
+	conf.Retention.Start()
+
 	apiServerSig := make(chan error)
 
 	e := echo.New()
@@ -0,0 +1,324 @@
+// Package metadata stores state attached to messages by MailHog, such as
+// tags, labels, the starred and read flags and the session they were
+// received in. The storage backend doesn't hold it: the metadata is kept in
+// memory, and only survives a restart if it's saved to a JSON file.
+package metadata
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jay-dee7/MailHog-Server/msgauth"
+)
+
+// Meta is the state attached to a message
+type Meta struct {
+	Tags    []string          `json:"tags"`
+	Labels  map[string]string `json:"labels"`
+	Starred bool              `json:"starred"`
+	Read    bool              `json:"read"`
+	// Session describes the SMTP session the message was received in
+	Session *Session `json:"session,omitempty"`
+	// Auth holds the DKIM, SPF and DMARC results of the message, if verified
+	Auth *msgauth.Results `json:"auth,omitempty"`
+}
+
+// Session describes the SMTP session a message was received in
+type Session struct {
+	RemoteAddr string `json:"remoteAddr"`
+	Helo       string `json:"helo"`
+	// Protocol is SMTP, or ESMTP with S and A suffixes for TLS and AUTH
+	Protocol string `json:"protocol"`
+	TLS      bool   `json:"tls"`
+	AuthUser string `json:"authUser,omitempty"`
+	// Tenant is the tenant the session belonged to, a rule may have routed
+	// the message to another one
+	Tenant   string    `json:"tenant"`
+	From     string    `json:"from"`
+	To       []string  `json:"to"`
+	Received time.Time `json:"received"`
+}
+
+// Update is a partial update of the metadata of a message, nil fields are
+// left unchanged
+type Update struct {
+	Tags    *[]string          `json:"tags"`
+	Labels  *map[string]string `json:"labels"`
+	Starred *bool              `json:"starred"`
+	Read    *bool              `json:"read"`
+}
+
+func (m *Meta) copy() Meta {
+	c := Meta{
+		Tags:    append([]string{}, m.Tags...),
+		Labels:  make(map[string]string, len(m.Labels)),
+		Starred: m.Starred,
+		Read:    m.Read,
+		Session: m.Session,
+		Auth:    m.Auth,
+	}
+	for k, v := range m.Labels {
+		c.Labels[k] = v
+	}
+	return c
+}
+
+// saveDelay batches the changes written to the metadata file, which is
+// rewritten as a whole and changes as every message is accepted
+const saveDelay = time.Second
+
+// Store holds the metadata of the messages of each tenant
+type Store struct {
+	mu   sync.RWMutex
+	path string
+	meta map[string]map[string]*Meta
+	// pending is set while changes are waiting to be written
+	pending bool
+	writeMu sync.Mutex
+
+	listenersMu sync.RWMutex
+	listeners   []func(tenant string)
+}
+
+// NewStore creates a metadata store, loading the metadata saved to path.
+// An empty path keeps the metadata in memory only.
+func NewStore(path string) (*Store, error) {
+	s := &Store{
+		path: path,
+		meta: make(map[string]map[string]*Meta),
+	}
+	if len(path) == 0 {
+		return s, nil
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &s.meta); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Get returns a copy of the metadata of a message
+func (s *Store) Get(tenant, id string) Meta {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	m, ok := s.meta[tenant][id]
+	if !ok {
+		m = &Meta{}
+	}
+	return m.copy()
+}
+
+// Tenants returns the tenants which have metadata
+func (s *Store) Tenants() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var tenants []string
+	for t := range s.meta {
+		tenants = append(tenants, t)
+	}
+	sort.Strings(tenants)
+	return tenants
+}
+
+// Subscribe registers fn to be called whenever the metadata of a tenant
+// changes, or messages are added to it
+func (s *Store) Subscribe(fn func(tenant string)) {
+	s.listenersMu.Lock()
+	defer s.listenersMu.Unlock()
+	s.listeners = append(s.listeners, fn)
+}
+
+// Notify calls the listeners for a change to the messages of a tenant
+// which doesn't change their metadata, such as a new message
+func (s *Store) Notify(tenant string) {
+	s.listenersMu.RLock()
+	defer s.listenersMu.RUnlock()
+	for _, fn := range s.listeners {
+		fn(tenant)
+	}
+}
+
+// Update applies a partial update to the metadata of a message
+func (s *Store) Update(tenant, id string, u Update) (Meta, error) {
+	defer s.Notify(tenant)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m := s.get(tenant, id)
+	if u.Tags != nil {
+		m.Tags = union(nil, *u.Tags)
+	}
+	if u.Labels != nil {
+		m.Labels = make(map[string]string, len(*u.Labels))
+		for k, v := range *u.Labels {
+			m.Labels[k] = v
+		}
+	}
+	if u.Starred != nil {
+		m.Starred = *u.Starred
+	}
+	if u.Read != nil {
+		m.Read = *u.Read
+	}
+	return m.copy(), s.save()
+}
+
+// Delete removes the metadata of a message
+func (s *Store) Delete(tenant, id string) error {
+	defer s.Notify(tenant)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.meta[tenant][id]; !ok {
+		return nil
+	}
+	delete(s.meta[tenant], id)
+	return s.save()
+}
+
+// DeleteAll removes the metadata of every message of the tenant
+func (s *Store) DeleteAll(tenant string) error {
+	defer s.Notify(tenant)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.meta[tenant]; !ok {
+		return nil
+	}
+	delete(s.meta, tenant)
+	return s.save()
+}
+
+// Find returns the IDs of the messages of the tenant whose metadata matches
+func (s *Store) Find(tenant string, match func(Meta) bool) map[string]bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ids := make(map[string]bool)
+	for id, m := range s.meta[tenant] {
+		if match(*m) {
+			ids[id] = true
+		}
+	}
+	return ids
+}
+
+// AddTags adds tags to a message, ignoring those it already has
+func (s *Store) AddTags(tenant, id string, tags ...string) error {
+	if len(tags) == 0 {
+		return nil
+	}
+	defer s.Notify(tenant)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m := s.get(tenant, id)
+	m.Tags = union(m.Tags, tags)
+	return s.save()
+}
+
+// Accepted is the state recorded when a message is accepted
+type Accepted struct {
+	Session *Session
+	Auth    *msgauth.Results
+	Tags    []string
+}
+
+// Accept records the state of a newly accepted message, and notifies the
+// listeners of it
+func (s *Store) Accept(tenant, id string, a Accepted) error {
+	defer s.Notify(tenant)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m := s.get(tenant, id)
+	m.Session = a.Session
+	m.Auth = a.Auth
+	m.Tags = union(m.Tags, a.Tags)
+	return s.save()
+}
+
+// get returns the metadata of a message, creating it if needed. The caller
+// must hold s.mu.
+func (s *Store) get(tenant, id string) *Meta {
+	if _, ok := s.meta[tenant]; !ok {
+		s.meta[tenant] = make(map[string]*Meta)
+	}
+	m, ok := s.meta[tenant][id]
+	if !ok {
+		m = &Meta{}
+		s.meta[tenant][id] = m
+	}
+	return m
+}
+
+func union(a, b []string) []string {
+	seen := make(map[string]bool)
+	var out []string
+	for _, v := range append(append([]string(nil), a...), b...) {
+		if len(v) > 0 && !seen[v] {
+			seen[v] = true
+			out = append(out, v)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// save schedules writing the metadata to its file, so that the changes
+// made within saveDelay are written at once. The caller must hold s.mu.
+func (s *Store) save() error {
+	if len(s.path) == 0 || s.pending {
+		return nil
+	}
+	s.pending = true
+	time.AfterFunc(saveDelay, func() {
+		if err := s.Flush(); err != nil {
+			log.Printf("[METADATA] Error saving %s: %s", s.path, err)
+		}
+	})
+	return nil
+}
+
+// Flush writes the pending changes to the metadata file
+func (s *Store) Flush() error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	s.mu.Lock()
+	if !s.pending {
+		s.mu.Unlock()
+		return nil
+	}
+	s.pending = false
+	b, err := json.Marshal(s.meta)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
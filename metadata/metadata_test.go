@@ -0,0 +1,63 @@
+package metadata
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestUpdate(t *testing.T) {
+	Convey("Partial updates should only change the given fields", t, func() {
+		s, _ := NewStore("")
+		So(s.AddTags("a", "m", "urgent", "qa", "urgent"), ShouldBeNil)
+
+		starred := true
+		m, err := s.Update("a", "m", Update{Starred: &starred, Labels: &map[string]string{"ticket": "QA-1"}})
+		So(err, ShouldBeNil)
+		So(m.Tags, ShouldResemble, []string{"qa", "urgent"})
+		So(m.Labels["ticket"], ShouldEqual, "QA-1")
+		So(m.Starred, ShouldBeTrue)
+
+		tags := []string{}
+		m, _ = s.Update("a", "m", Update{Tags: &tags})
+		So(m.Tags, ShouldBeEmpty)
+		So(m.Starred, ShouldBeTrue)
+		So(s.Get("b", "m").Starred, ShouldBeFalse)
+	})
+
+	Convey("Metadata should be reloaded from its file", t, func() {
+		dir, _ := ioutil.TempDir("", "metadata")
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "metadata.json")
+
+		s, _ := NewStore(path)
+		s.AddTags("a", "m", "urgent")
+		_, err := os.Stat(path)
+		So(os.IsNotExist(err), ShouldBeTrue)
+		So(s.Flush(), ShouldBeNil)
+
+		s, err = NewStore(path)
+		So(err, ShouldBeNil)
+		So(s.Get("a", "m").Tags, ShouldResemble, []string{"urgent"})
+		So(s.Find("a", func(m Meta) bool { return len(m.Tags) > 0 }), ShouldResemble, map[string]bool{"m": true})
+	})
+}
+
+func TestNotify(t *testing.T) {
+	Convey("Listeners should be notified of changes to a tenant", t, func() {
+		s, _ := NewStore("")
+		var tenants []string
+		s.Subscribe(func(tenant string) { tenants = append(tenants, tenant) })
+
+		read := true
+		m, _ := s.Update("a", "m", Update{Read: &read})
+		So(m.Read, ShouldBeTrue)
+		s.Notify("b")
+		s.Delete("a", "m")
+		So(tenants, ShouldResemble, []string{"a", "b", "a"})
+		So(s.Get("a", "m").Read, ShouldBeFalse)
+	})
+}
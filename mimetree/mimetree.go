@@ -0,0 +1,297 @@
+// Package mimetree parses raw messages into a tree of MIME parts.
+package mimetree
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mailhog/data"
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+// ErrPartNotFound is returned when a part path does not exist in a message
+var ErrPartNotFound = errors.New("mime part not found")
+
+// Part represents a single node in the MIME tree of a message
+type Part struct {
+	// Path is the dot separated, zero based position of the part, e.g. 1.2.0.
+	// The root of the tree has an empty path.
+	Path        string
+	Header      textproto.MIMEHeader
+	ContentType string
+	Params      map[string]string
+	// Body is the content of the part with its transfer encoding intact
+	Body  []byte
+	Parts []*Part
+}
+
+// Parse parses a raw RFC 5322 message into its MIME tree
+func Parse(raw []byte) (*Part, error) {
+	r := textproto.NewReader(bufio.NewReader(bytes.NewReader(raw)))
+	header, err := r.ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	body, err := ioutil.ReadAll(r.R)
+	if err != nil {
+		return nil, err
+	}
+	return newPart("", header, body), nil
+}
+
+// Header returns the values of a header of a stored message. Stored headers
+// keep the case they were received with, so the name is matched ignoring case.
+func Header(message *data.Message, name string) []string {
+	if message.Content == nil {
+		return nil
+	}
+	var values []string
+	for k, v := range message.Content.Headers {
+		if strings.EqualFold(k, name) {
+			values = append(values, v...)
+		}
+	}
+	return values
+}
+
+// Raw returns the message exactly as it was received over SMTP.
+//
+// Messages stored without their raw SMTP data are reconstructed from the
+// parsed headers and body, which loses the original header order and folding.
+func Raw(message *data.Message) []byte {
+	if message.Raw != nil && len(message.Raw.Data) > 0 {
+		// the protocol strips the CRLF which precedes the terminating dot,
+		// but it belongs to the message content
+		raw := message.Raw.Data
+		if !strings.HasSuffix(raw, "\r\n") {
+			raw += "\r\n"
+		}
+		return []byte(raw)
+	}
+
+	if message.Content == nil {
+		return nil
+	}
+
+	keys := make([]string, 0, len(message.Content.Headers))
+	for h := range message.Content.Headers {
+		keys = append(keys, h)
+	}
+	sort.Strings(keys)
+
+	b := make([]byte, 0, message.Content.Size)
+	for _, h := range keys {
+		for _, v := range message.Content.Headers[h] {
+			b = append(b, []byte(h+": "+v+"\r\n")...)
+		}
+	}
+	return append(b, []byte("\r\n"+message.Content.Body)...)
+}
+
+func newPart(path string, header textproto.MIMEHeader, body []byte) *Part {
+	p := &Part{
+		Path:        path,
+		Header:      header,
+		ContentType: "text/plain",
+		Params:      map[string]string{"charset": "us-ascii"},
+		Body:        body,
+	}
+
+	if ct := header.Get("Content-Type"); len(ct) > 0 {
+		if mt, params, err := mime.ParseMediaType(ct); err == nil {
+			p.ContentType = mt
+			p.Params = params
+		}
+	}
+
+	if p.IsMultipart() {
+		// a broken multipart body is kept as a leaf so its content
+		// is still reachable
+		if parts, err := parseMultipart(path, body, p.Params["boundary"]); err == nil {
+			p.Parts = parts
+		}
+	}
+
+	return p
+}
+
+func parseMultipart(path string, body []byte, boundary string) ([]*Part, error) {
+	if len(boundary) == 0 {
+		return nil, errors.New("missing multipart boundary")
+	}
+
+	var parts []*Part
+	mr := multipart.NewReader(bytes.NewReader(body), boundary)
+	for i := 0; ; i++ {
+		mp, err := mr.NextRawPart()
+		if err == io.EOF {
+			return parts, nil
+		}
+		if err != nil {
+			return parts, err
+		}
+		b, err := ioutil.ReadAll(mp)
+		if err != nil {
+			return parts, err
+		}
+		parts = append(parts, newPart(childPath(path, i), mp.Header, b))
+	}
+}
+
+func childPath(parent string, i int) string {
+	if len(parent) == 0 {
+		return strconv.Itoa(i)
+	}
+	return parent + "." + strconv.Itoa(i)
+}
+
+// IsMultipart returns true if the part is a multipart container
+func (p *Part) IsMultipart() bool {
+	return strings.HasPrefix(p.ContentType, "multipart/")
+}
+
+// IsText returns true if the part contains text/* content
+func (p *Part) IsText() bool {
+	return strings.HasPrefix(p.ContentType, "text/")
+}
+
+// IsAttachment returns true if the part is a leaf which is either marked as
+// an attachment or carries a file name
+func (p *Part) IsAttachment() bool {
+	if p.IsMultipart() {
+		return false
+	}
+	return p.Disposition() == "attachment" || len(p.Filename()) > 0
+}
+
+// ID returns the path which Find resolves to the part. It's the path of
+// the part, except for the body of a message which isn't multipart, whose
+// empty path is exposed as part 0.
+func (p *Part) ID() string {
+	if len(p.Path) == 0 && !p.IsMultipart() {
+		return "0"
+	}
+	return p.Path
+}
+
+// Find returns the part at the given path.
+//
+// For messages which aren't multipart the message body itself is part 0.
+func (p *Part) Find(path string) (*Part, error) {
+	if len(path) == 0 {
+		return p, nil
+	}
+	if !p.IsMultipart() && path == "0" {
+		return p, nil
+	}
+
+	current := p
+	for _, s := range strings.Split(path, ".") {
+		i, err := strconv.Atoi(s)
+		if err != nil || i < 0 || i >= len(current.Parts) {
+			return nil, ErrPartNotFound
+		}
+		current = current.Parts[i]
+	}
+	return current, nil
+}
+
+// Walk calls fn for the part and each of its descendants, depth first
+func (p *Part) Walk(fn func(part *Part)) {
+	fn(p)
+	for _, c := range p.Parts {
+		c.Walk(fn)
+	}
+}
+
+// Disposition returns the content disposition of the part, e.g. attachment
+func (p *Part) Disposition() string {
+	d, _, err := mime.ParseMediaType(p.Header.Get("Content-Disposition"))
+	if err != nil {
+		return ""
+	}
+	return d
+}
+
+// Filename returns the file name of the part from either the
+// Content-Disposition or Content-Type header
+func (p *Part) Filename() string {
+	if _, params, err := mime.ParseMediaType(p.Header.Get("Content-Disposition")); err == nil {
+		if len(params["filename"]) > 0 {
+			return decodeWord(params["filename"])
+		}
+	}
+	return decodeWord(p.Params["name"])
+}
+
+// ContentID returns the Content-ID of the part without angle brackets
+func (p *Part) ContentID() string {
+	return strings.Trim(strings.TrimSpace(p.Header.Get("Content-ID")), "<>")
+}
+
+// Decode returns the body of the part with its transfer encoding removed
+func (p *Part) Decode() ([]byte, error) {
+	switch strings.ToLower(strings.TrimSpace(p.Header.Get("Content-Transfer-Encoding"))) {
+	case "base64":
+		return ioutil.ReadAll(base64.NewDecoder(base64.StdEncoding, bytes.NewReader(p.Body)))
+	case "quoted-printable":
+		return ioutil.ReadAll(quotedprintable.NewReader(bytes.NewReader(p.Body)))
+	default:
+		return p.Body, nil
+	}
+}
+
+// Text returns the decoded body of the part converted to UTF-8
+func (p *Part) Text() (string, error) {
+	b, err := p.Decode()
+	if err != nil {
+		return "", err
+	}
+	return toUTF8(b, p.Params["charset"])
+}
+
+func toUTF8(b []byte, charset string) (string, error) {
+	switch strings.ToLower(charset) {
+	case "", "utf-8", "utf8", "us-ascii", "ascii":
+		return string(b), nil
+	}
+
+	enc, err := htmlindex.Get(charset)
+	if err != nil {
+		return "", err
+	}
+	out, err := enc.NewDecoder().Bytes(b)
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
+
+var wordDecoder = &mime.WordDecoder{
+	CharsetReader: func(charset string, input io.Reader) (io.Reader, error) {
+		enc, err := htmlindex.Get(charset)
+		if err != nil {
+			return nil, err
+		}
+		return enc.NewDecoder().Reader(input), nil
+	},
+}
+
+func decodeWord(s string) string {
+	d, err := wordDecoder.DecodeHeader(s)
+	if err != nil {
+		return s
+	}
+	return d
+}
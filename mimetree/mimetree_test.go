@@ -0,0 +1,96 @@
+package mimetree
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+var nestedMessage = "From: test@mailhog.example\r\n" +
+	"Content-Type: multipart/mixed; boundary=outer\r\n" +
+	"\r\n" +
+	"--outer\r\n" +
+	"Content-Type: multipart/alternative; boundary=inner\r\n" +
+	"\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/plain; charset=iso-8859-1\r\n" +
+	"Content-Transfer-Encoding: quoted-printable\r\n" +
+	"\r\n" +
+	"caf=E9 =\r\n" +
+	"au lait\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/html; charset=utf-8\r\n" +
+	"\r\n" +
+	"<p>hi</p>\r\n" +
+	"--inner--\r\n" +
+	"--outer\r\n" +
+	"Content-Type: application/octet-stream; name=\"data.bin\"\r\n" +
+	"Content-Disposition: attachment; filename=\"data.bin\"\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"Content-ID: <data@mailhog>\r\n" +
+	"\r\n" +
+	"aGVs\r\n" +
+	"bG8=\r\n" +
+	"--outer--\r\n"
+
+func TestParse(t *testing.T) {
+	Convey("Parse should build the MIME tree", t, func() {
+		tree, err := Parse([]byte(nestedMessage))
+		So(err, ShouldBeNil)
+		So(tree.ContentType, ShouldEqual, "multipart/mixed")
+		So(tree.Parts, ShouldHaveLength, 2)
+		So(tree.Parts[0].Parts, ShouldHaveLength, 2)
+		So(tree.Parts[0].Parts[1].Path, ShouldEqual, "0.1")
+	})
+
+	Convey("Parse should treat a single part message as part 0", t, func() {
+		tree, err := Parse([]byte("Subject: hi\r\n\r\nbody\r\n"))
+		So(err, ShouldBeNil)
+		p, err := tree.Find("0")
+		So(err, ShouldBeNil)
+		So(p, ShouldEqual, tree)
+		So(tree.ID(), ShouldEqual, "0")
+	})
+
+	Convey("ID should return the path of parts of multipart messages", t, func() {
+		tree, _ := Parse([]byte(nestedMessage))
+		So(tree.ID(), ShouldEqual, "")
+		So(tree.Parts[0].Parts[1].ID(), ShouldEqual, "0.1")
+	})
+}
+
+func TestFind(t *testing.T) {
+	Convey("Find should return nested parts", t, func() {
+		tree, _ := Parse([]byte(nestedMessage))
+
+		p, err := tree.Find("0.1")
+		So(err, ShouldBeNil)
+		So(p.ContentType, ShouldEqual, "text/html")
+
+		_, err = tree.Find("0.2")
+		So(err, ShouldEqual, ErrPartNotFound)
+		_, err = tree.Find("x")
+		So(err, ShouldEqual, ErrPartNotFound)
+	})
+}
+
+func TestDecode(t *testing.T) {
+	Convey("Text should decode quoted-printable and convert the charset", t, func() {
+		tree, _ := Parse([]byte(nestedMessage))
+		p, _ := tree.Find("0.0")
+		text, err := p.Text()
+		So(err, ShouldBeNil)
+		So(text, ShouldEqual, "café au lait")
+	})
+
+	Convey("Decode should decode base64", t, func() {
+		tree, _ := Parse([]byte(nestedMessage))
+		p, _ := tree.Find("1")
+		b, err := p.Decode()
+		So(err, ShouldBeNil)
+		So(string(b), ShouldEqual, "hello")
+		So(p.Filename(), ShouldEqual, "data.bin")
+		So(p.Disposition(), ShouldEqual, "attachment")
+		So(p.ContentID(), ShouldEqual, "data@mailhog")
+	})
+}
@@ -0,0 +1,316 @@
+package msgauth
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"hash"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DKIMResult is the verification of a DKIM signature
+type DKIMResult struct {
+	Result   string `json:"result"`
+	Domain   string `json:"domain,omitempty"`
+	Selector string `json:"selector,omitempty"`
+	// Identity is the i= tag, which defaults to the domain
+	Identity string `json:"identity,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// header is a header field as received, Raw includes the name, folding and
+// the trailing CRLF
+type header struct {
+	Name string
+	Raw  string
+}
+
+// Value returns the header value, folding included
+func (h header) Value() string {
+	return h.Raw[strings.Index(h.Raw, ":")+1:]
+}
+
+// splitMessage splits a message into its header fields and body, with lines
+// ending in CRLF
+func splitMessage(raw []byte) ([]header, []byte) {
+	raw = bytes.Replace(raw, []byte("\r\n"), []byte("\n"), -1)
+	raw = bytes.Replace(raw, []byte("\n"), []byte("\r\n"), -1)
+	if !bytes.HasSuffix(raw, []byte("\r\n")) {
+		raw = append(raw, '\r', '\n')
+	}
+
+	var headers []header
+	for len(raw) > 0 {
+		if bytes.HasPrefix(raw, []byte("\r\n")) {
+			return headers, raw[2:]
+		}
+		i := bytes.Index(raw, []byte("\r\n"))
+		line := string(raw[:i+2])
+		raw = raw[i+2:]
+
+		if (line[0] == ' ' || line[0] == '\t') && len(headers) > 0 {
+			headers[len(headers)-1].Raw += line
+			continue
+		}
+		name := line
+		if c := strings.Index(line, ":"); c >= 0 {
+			name = line[:c]
+		}
+		headers = append(headers, header{Name: strings.TrimSpace(name), Raw: line})
+	}
+	return headers, nil
+}
+
+var wspRegexp = regexp.MustCompile(`[ \t]+`)
+
+// canonicalHeader canonicalizes a header field, the simple algorithm leaves
+// it unchanged
+func canonicalHeader(h header, relaxed bool) string {
+	if !relaxed {
+		return h.Raw
+	}
+	v := strings.Replace(h.Value(), "\r\n", "", -1)
+	v = strings.TrimSpace(wspRegexp.ReplaceAllString(v, " "))
+	return strings.ToLower(h.Name) + ":" + v + "\r\n"
+}
+
+// canonicalBody canonicalizes a body, which ends with a single CRLF unless
+// it's empty with the relaxed algorithm
+func canonicalBody(body []byte, relaxed bool) []byte {
+	if relaxed {
+		lines := bytes.Split(body, []byte("\r\n"))
+		for i, l := range lines {
+			lines[i] = bytes.TrimRight(wspRegexp.ReplaceAll(l, []byte(" ")), " ")
+		}
+		body = bytes.Join(lines, []byte("\r\n"))
+	}
+
+	body = bytes.TrimRight(body, "\r\n")
+	if len(body) == 0 && relaxed {
+		return nil
+	}
+	return append(body, '\r', '\n')
+}
+
+// parseTags parses a tag list such as a=rsa-sha256; d=example.com
+func parseTags(s string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, t := range strings.Split(s, ";") {
+		if len(strings.TrimSpace(t)) == 0 {
+			continue
+		}
+		kv := strings.SplitN(t, "=", 2)
+		if len(kv) != 2 {
+			return nil, errors.New("invalid tag: " + strings.TrimSpace(t))
+		}
+		tags[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	return tags, nil
+}
+
+func stripWSP(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == ' ' || r == '\t' || r == '\r' || r == '\n' {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// signatureValueRegexp matches the value of the b= tag
+var signatureValueRegexp = regexp.MustCompile(`(^|;)(\s*b\s*=)[^;]*`)
+
+// verifyDKIM verifies every DKIM-Signature of a message
+func verifyDKIM(resolver Resolver, headers []header, body []byte, now time.Time) []DKIMResult {
+	var results []DKIMResult
+	for _, h := range headers {
+		if strings.EqualFold(h.Name, "DKIM-Signature") {
+			results = append(results, verifySignature(resolver, headers, body, h, now))
+		}
+	}
+	return results
+}
+
+func verifySignature(resolver Resolver, headers []header, body []byte, sig header, now time.Time) DKIMResult {
+	tags, err := parseTags(sig.Value())
+	if err != nil {
+		return DKIMResult{Result: PermError, Error: err.Error()}
+	}
+	res := DKIMResult{Domain: strings.ToLower(tags["d"]), Selector: tags["s"], Identity: tags["i"]}
+	fail := func(result, msg string) DKIMResult {
+		res.Result, res.Error = result, msg
+		return res
+	}
+
+	for _, t := range []string{"v", "a", "b", "bh", "d", "h", "s"} {
+		if _, ok := tags[t]; !ok {
+			return fail(PermError, "signature requires the "+t+"= tag")
+		}
+	}
+	if tags["v"] != "1" {
+		return fail(PermError, "unsupported version "+tags["v"])
+	}
+	if len(res.Identity) == 0 {
+		res.Identity = "@" + res.Domain
+	} else if i := strings.ToLower(res.Identity); !strings.HasSuffix(i, "@"+res.Domain) && !strings.HasSuffix(i, "."+res.Domain) {
+		return fail(PermError, "identity isn't within the signing domain")
+	}
+	if x, ok := tags["x"]; ok {
+		if exp, err := strconv.ParseInt(x, 10, 64); err == nil && now.Unix() > exp {
+			return fail(Fail, "signature expired")
+		}
+	}
+
+	var newHash func() hash.Hash
+	var cryptoHash crypto.Hash
+	algo := strings.SplitN(tags["a"], "-", 2)
+	switch {
+	case len(algo) == 2 && algo[1] == "sha256":
+		newHash, cryptoHash = sha256.New, crypto.SHA256
+	case len(algo) == 2 && algo[1] == "sha1":
+		newHash, cryptoHash = sha1.New, crypto.SHA1
+	default:
+		return fail(PermError, "unsupported algorithm "+tags["a"])
+	}
+
+	canon := strings.SplitN(tags["c"], "/", 2)
+	relaxedHeaders := canon[0] == "relaxed"
+	relaxedBody := len(canon) == 2 && canon[1] == "relaxed"
+
+	signed := strings.Split(tags["h"], ":")
+	from := false
+	for i, name := range signed {
+		signed[i] = strings.TrimSpace(name)
+		from = from || strings.EqualFold(signed[i], "From")
+	}
+	if !from {
+		return fail(PermError, "From header isn't signed")
+	}
+
+	// body hash
+	cbody := canonicalBody(body, relaxedBody)
+	if l, ok := tags["l"]; ok {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 0 || n > len(cbody) {
+			return fail(PermError, "invalid body length")
+		}
+		cbody = cbody[:n]
+	}
+	bh := newHash()
+	bh.Write(cbody)
+	expected, err := base64.StdEncoding.DecodeString(stripWSP(tags["bh"]))
+	if err != nil {
+		return fail(PermError, "invalid body hash")
+	}
+	if subtle.ConstantTimeCompare(bh.Sum(nil), expected) != 1 {
+		return fail(Fail, "body hash mismatch")
+	}
+
+	// header hash, repeated headers are signed from the bottom up
+	hh := newHash()
+	used := make(map[int]bool)
+	for _, name := range signed {
+		for i := len(headers) - 1; i >= 0; i-- {
+			if !used[i] && strings.EqualFold(headers[i].Name, name) {
+				used[i] = true
+				hh.Write([]byte(canonicalHeader(headers[i], relaxedHeaders)))
+				break
+			}
+		}
+	}
+	unsigned := sig
+	unsigned.Raw = sig.Raw[:len(sig.Raw)-len(sig.Value())] + signatureValueRegexp.ReplaceAllString(sig.Value(), "$1$2")
+	hh.Write([]byte(strings.TrimSuffix(canonicalHeader(unsigned, relaxedHeaders), "\r\n")))
+	digest := hh.Sum(nil)
+
+	signature, err := base64.StdEncoding.DecodeString(stripWSP(tags["b"]))
+	if err != nil {
+		return fail(PermError, "invalid signature")
+	}
+
+	key, result, err := lookupKey(resolver, res.Selector+"._domainkey."+res.Domain)
+	if err != nil {
+		return fail(result, err.Error())
+	}
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if algo[0] != "rsa" {
+			return fail(PermError, "key doesn't match the algorithm")
+		}
+		err = rsa.VerifyPKCS1v15(k, cryptoHash, digest, signature)
+	case ed25519.PublicKey:
+		if algo[0] != "ed25519" || cryptoHash != crypto.SHA256 {
+			return fail(PermError, "key doesn't match the algorithm")
+		}
+		if !ed25519.Verify(k, digest, signature) {
+			err = errors.New("invalid signature")
+		}
+	}
+	if err != nil {
+		return fail(Fail, "signature verification failed")
+	}
+
+	res.Result = Pass
+	return res
+}
+
+// lookupKey fetches the public key of a selector, returning the result to
+// report if it fails
+func lookupKey(resolver Resolver, name string) (crypto.PublicKey, string, error) {
+	txt, err := resolver.LookupTXT(name)
+	if isNotFound(err) {
+		return nil, PermError, errors.New("no key for signature")
+	}
+	if err != nil {
+		return nil, TempError, err
+	}
+
+	tags, err := parseTags(strings.Join(txt, ""))
+	if err != nil {
+		return nil, PermError, err
+	}
+	if v, ok := tags["v"]; ok && v != "DKIM1" {
+		return nil, PermError, errors.New("unsupported key version " + v)
+	}
+	p := stripWSP(tags["p"])
+	if len(p) == 0 {
+		return nil, PermError, errors.New("key revoked")
+	}
+	b, err := base64.StdEncoding.DecodeString(p)
+	if err != nil {
+		return nil, PermError, errors.New("invalid key")
+	}
+
+	switch k := tags["k"]; k {
+	case "", "rsa":
+		if key, err := x509.ParsePKIXPublicKey(b); err == nil {
+			if rsaKey, ok := key.(*rsa.PublicKey); ok {
+				return rsaKey, "", nil
+			}
+			return nil, PermError, errors.New("key isn't an RSA key")
+		}
+		key, err := x509.ParsePKCS1PublicKey(b)
+		if err != nil {
+			return nil, PermError, errors.New("invalid key")
+		}
+		return key, "", nil
+	case "ed25519":
+		if len(b) != ed25519.PublicKeySize {
+			return nil, PermError, errors.New("invalid key")
+		}
+		return ed25519.PublicKey(b), "", nil
+	default:
+		return nil, PermError, errors.New("unsupported key type " + k)
+	}
+}
@@ -0,0 +1,118 @@
+package msgauth
+
+import (
+	"net/mail"
+	"strings"
+)
+
+// DMARCResult is the evaluation of the DMARC policy of the From domain
+type DMARCResult struct {
+	Result string `json:"result"`
+	// Domain is the domain of the From header
+	Domain string `json:"domain,omitempty"`
+	// Policy is the requested disposition of failing messages
+	Policy      string `json:"policy,omitempty"`
+	DKIMAligned bool   `json:"dkimAligned"`
+	SPFAligned  bool   `json:"spfAligned"`
+	Error       string `json:"error,omitempty"`
+}
+
+// organizationalDomain approximates the registered domain of a name by its
+// last two labels, since the public suffix list isn't available
+func organizationalDomain(domain string) string {
+	labels := strings.Split(domain, ".")
+	if len(labels) <= 2 {
+		return domain
+	}
+	return strings.Join(labels[len(labels)-2:], ".")
+}
+
+// aligned compares a domain with the From domain, exactly for strict
+// alignment, or by organizational domain for relaxed alignment
+func aligned(domain, from string, strict bool) bool {
+	domain, from = strings.ToLower(domain), strings.ToLower(from)
+	if strict {
+		return domain == from
+	}
+	return organizationalDomain(domain) == organizationalDomain(from)
+}
+
+// dmarcRecord returns the tags of the DMARC record of a domain, or nil if
+// it has none
+func dmarcRecord(resolver Resolver, domain string) (map[string]string, error) {
+	txt, err := resolver.LookupTXT("_dmarc." + domain)
+	if isNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, &resultError{TempError, err.Error()}
+	}
+
+	for _, t := range txt {
+		if !strings.HasPrefix(strings.TrimSpace(t), "v=DMARC1") {
+			continue
+		}
+		tags, err := parseTags(t)
+		if err != nil {
+			return nil, permError(err.Error())
+		}
+		return tags, nil
+	}
+	return nil, nil
+}
+
+// checkDMARC evaluates the DMARC policy of the From domain against the
+// DKIM and SPF results
+func checkDMARC(resolver Resolver, from []string, dkim []DKIMResult, spf SPFResult) DMARCResult {
+	if len(from) != 1 {
+		return DMARCResult{Result: PermError, Error: "message requires a single From header"}
+	}
+	addr, err := mail.ParseAddress(from[0])
+	if err != nil {
+		return DMARCResult{Result: PermError, Error: err.Error()}
+	}
+	domain := strings.ToLower(addr.Address[strings.LastIndex(addr.Address, "@")+1:])
+	res := DMARCResult{Domain: domain}
+
+	// the policy of the organizational domain applies to its subdomains
+	tags, err := dmarcRecord(resolver, domain)
+	subdomain := false
+	if err == nil && tags == nil {
+		if org := organizationalDomain(domain); org != domain {
+			tags, err = dmarcRecord(resolver, org)
+			subdomain = true
+		}
+	}
+	if err != nil {
+		res.Result, res.Error = err.(*resultError).result, err.Error()
+		return res
+	}
+	if tags == nil {
+		res.Result = None
+		return res
+	}
+
+	res.Policy = tags["p"]
+	if sp, ok := tags["sp"]; ok && subdomain {
+		res.Policy = sp
+	}
+	switch res.Policy {
+	case "none", "quarantine", "reject":
+	default:
+		res.Result, res.Error = PermError, "invalid policy "+res.Policy
+		return res
+	}
+
+	for _, d := range dkim {
+		if d.Result == Pass && aligned(d.Domain, domain, tags["adkim"] == "s") {
+			res.DKIMAligned = true
+		}
+	}
+	res.SPFAligned = spf.Result == Pass && aligned(spf.Domain, domain, tags["aspf"] == "s")
+
+	res.Result = Fail
+	if res.DKIMAligned || res.SPFAligned {
+		res.Result = Pass
+	}
+	return res
+}
@@ -0,0 +1,100 @@
+// Package msgauth verifies the DKIM signatures of messages, evaluates SPF
+// for the connecting client and computes DMARC alignment, using a DNS
+// resolver or a zone file standing in for DNS.
+package msgauth
+
+import (
+	"net"
+	"strings"
+	"time"
+)
+
+// Results of the checks
+const (
+	None      = "none"
+	Pass      = "pass"
+	Fail      = "fail"
+	SoftFail  = "softfail"
+	Neutral   = "neutral"
+	TempError = "temperror"
+	PermError = "permerror"
+)
+
+// resultError carries the result to report for an error
+type resultError struct {
+	result string
+	msg    string
+}
+
+func (e *resultError) Error() string { return e.msg }
+
+func permError(msg string) error { return &resultError{PermError, msg} }
+
+// Results are the authentication results of a message
+type Results struct {
+	// DKIM holds a result for each signature
+	DKIM  []DKIMResult `json:"dkim"`
+	SPF   SPFResult    `json:"spf"`
+	DMARC DMARCResult  `json:"dmarc"`
+}
+
+// Verifier checks the authentication of accepted messages
+type Verifier struct {
+	Resolver Resolver
+	// Hostname identifies the verifier in the Authentication-Results header
+	Hostname string
+}
+
+// NewVerifier creates a verifier resolving records from the zone file at
+// path, or from DNS if path is empty
+func NewVerifier(hostname, zonePath string) (*Verifier, error) {
+	v := &Verifier{Resolver: DNSResolver{}, Hostname: hostname}
+	if len(zonePath) > 0 {
+		z, err := LoadZone(zonePath)
+		if err != nil {
+			return nil, err
+		}
+		v.Resolver = z
+	}
+	return v, nil
+}
+
+// Verify checks the raw message received from the client at ip, which
+// greeted with helo and sent from the envelope sender
+func (v *Verifier) Verify(raw []byte, ip net.IP, helo, sender string) *Results {
+	headers, body := splitMessage(raw)
+
+	var from []string
+	for _, h := range headers {
+		if strings.EqualFold(h.Name, "From") {
+			from = append(from, strings.TrimSpace(strings.Replace(h.Value(), "\r\n", "", -1)))
+		}
+	}
+
+	res := &Results{
+		DKIM: verifyDKIM(v.Resolver, headers, body, time.Now()),
+		SPF:  checkSPF(v.Resolver, ip, helo, sender),
+	}
+	if len(res.DKIM) == 0 {
+		res.DKIM = []DKIMResult{}
+	}
+	res.DMARC = checkDMARC(v.Resolver, from, res.DKIM, res.SPF)
+	return res
+}
+
+// Header returns the value of an Authentication-Results header for the results
+func (r *Results) Header(hostname string) string {
+	parts := []string{hostname}
+	if len(r.DKIM) == 0 {
+		parts = append(parts, "dkim="+None)
+	}
+	for _, d := range r.DKIM {
+		parts = append(parts, "dkim="+d.Result+" header.d="+d.Domain+" header.s="+d.Selector)
+	}
+	parts = append(parts, "spf="+r.SPF.Result+" smtp.mailfrom="+r.SPF.Domain)
+	dmarc := "dmarc=" + r.DMARC.Result
+	if len(r.DMARC.Domain) > 0 {
+		dmarc += " header.from=" + r.DMARC.Domain
+	}
+	return strings.Join(append(parts, dmarc), "; ")
+}
@@ -0,0 +1,90 @@
+package msgauth
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"net"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const message = "From: Shop <orders@shop.example>\r\n" +
+	"To: customer@mailhog.example\r\n" +
+	"Subject: Your  order\r\n" +
+	"\r\n" +
+	"Thanks for your order \r\n" +
+	"\r\n"
+
+// sign adds a relaxed/relaxed rsa-sha256 DKIM-Signature to a message
+func sign(key *rsa.PrivateKey, msg string) string {
+	headers, body := splitMessage([]byte(msg))
+	bh := sha256.Sum256(canonicalBody(body, true))
+
+	sig := header{Name: "DKIM-Signature", Raw: "DKIM-Signature: v=1; a=rsa-sha256; c=relaxed/relaxed; d=shop.example; s=mail;\r\n" +
+		" h=from:to:subject; bh=" + base64.StdEncoding.EncodeToString(bh[:]) + "; b="}
+	h := sha256.New()
+	for _, hdr := range headers {
+		h.Write([]byte(canonicalHeader(hdr, true)))
+	}
+	h.Write([]byte(strings.TrimSuffix(canonicalHeader(sig, true), "\r\n")))
+	b, _ := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, h.Sum(nil))
+
+	return sig.Raw + base64.StdEncoding.EncodeToString(b) + "\r\n" + msg
+}
+
+func TestVerify(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	p := base64.StdEncoding.EncodeToString(pub)
+
+	zone, err := ParseZone(strings.NewReader(`$ORIGIN shop.example.
+@                 IN TXT "v=spf1 ip4:192.0.2.0/24 a:mx.shop.example -all"
+mx           300  IN A   198.51.100.7
+mail._domainkey   IN TXT ( "v=DKIM1; k=rsa; "  ; split key
+                           "p=` + p[:40] + `" "` + p[40:] + `" )
+_dmarc            IN TXT "v=DMARC1; p=reject"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := &Verifier{Resolver: zone, Hostname: "mailhog.example"}
+
+	Convey("A signed message from an authorized IP should pass", t, func() {
+		res := v.Verify([]byte(sign(key, message)), net.ParseIP("192.0.2.10"), "mx.shop.example", "orders@shop.example")
+		So(res.DKIM, ShouldHaveLength, 1)
+		So(res.DKIM[0].Result, ShouldEqual, Pass)
+		So(res.SPF.Result, ShouldEqual, Pass)
+		So(res.DMARC.Result, ShouldEqual, Pass)
+		So(res.DMARC.Policy, ShouldEqual, "reject")
+		So(res.Header("mailhog.example"), ShouldEqual, "mailhog.example; dkim=pass header.d=shop.example header.s=mail; spf=pass smtp.mailfrom=shop.example; dmarc=pass header.from=shop.example")
+
+		res = v.Verify([]byte(sign(key, message)), net.ParseIP("198.51.100.7"), "mx.shop.example", "orders@shop.example")
+		So(res.SPF.Result, ShouldEqual, Pass)
+	})
+
+	Convey("A modified message from an unauthorized IP should fail", t, func() {
+		signed := strings.Replace(sign(key, message), "Thanks", "Thank", 1)
+		res := v.Verify([]byte(signed), net.ParseIP("203.0.113.1"), "mx.other.example", "orders@shop.example")
+		So(res.DKIM[0].Result, ShouldEqual, Fail)
+		So(res.DKIM[0].Error, ShouldEqual, "body hash mismatch")
+		So(res.SPF.Result, ShouldEqual, Fail)
+		So(res.DMARC.Result, ShouldEqual, Fail)
+	})
+
+	Convey("An unsigned message from an unknown domain should have no results", t, func() {
+		msg := strings.Replace(message, "shop.example", "other.example", 1)
+		res := v.Verify([]byte(msg), net.ParseIP("192.0.2.10"), "mx.other.example", "orders@other.example")
+		So(res.DKIM, ShouldBeEmpty)
+		So(res.SPF.Result, ShouldEqual, None)
+		So(res.DMARC.Result, ShouldEqual, None)
+	})
+}
@@ -0,0 +1,257 @@
+package msgauth
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ErrNotFound is returned by a Zone for a name without records of the type
+var ErrNotFound = errors.New("no such record")
+
+// Resolver looks up the DNS records used to verify messages
+type Resolver interface {
+	LookupTXT(name string) ([]string, error)
+	LookupIP(host string) ([]net.IP, error)
+	LookupMX(name string) ([]*net.MX, error)
+}
+
+// DNSResolver resolves records using the system resolver
+type DNSResolver struct{}
+
+// LookupTXT implements Resolver
+func (DNSResolver) LookupTXT(name string) ([]string, error) { return net.LookupTXT(name) }
+
+// LookupIP implements Resolver
+func (DNSResolver) LookupIP(host string) ([]net.IP, error) { return net.LookupIP(host) }
+
+// LookupMX implements Resolver
+func (DNSResolver) LookupMX(name string) ([]*net.MX, error) { return net.LookupMX(name) }
+
+// isNotFound returns true if err means the name has no records, as opposed
+// to a failure of the lookup
+func isNotFound(err error) bool {
+	if err == ErrNotFound {
+		return true
+	}
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+// Zone resolves records from a zone file instead of DNS, so that messages
+// can be verified against keys and policies which aren't published
+type Zone struct {
+	txt map[string][]string
+	ip  map[string][]net.IP
+	mx  map[string][]*net.MX
+}
+
+// LoadZone reads a zone file
+func LoadZone(path string) (*Zone, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseZone(f)
+}
+
+// ParseZone reads TXT, A, AAAA and MX records in zone file format:
+//
+//	$ORIGIN example.com.
+//	@                   IN TXT "v=spf1 ip4:192.0.2.0/24 -all"
+//	mail._domainkey 300 IN TXT ( "v=DKIM1; k=rsa; "
+//	                             "p=MIIBIjANBg..." )
+//	_dmarc              IN TXT "v=DMARC1; p=reject"
+//	mx                  IN A   192.0.2.1
+//	@                   IN MX  10 mx
+//
+// Names without a trailing dot are relative to the $ORIGIN, other record
+// types are ignored.
+func ParseZone(r io.Reader) (*Zone, error) {
+	z := &Zone{
+		txt: make(map[string][]string),
+		ip:  make(map[string][]net.IP),
+		mx:  make(map[string][]*net.MX),
+	}
+
+	var origin, last, entry string
+	depth, n := 0, 0
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		n++
+		line := stripComment(scanner.Text())
+		if len(strings.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		// parentheses continue a record on the following lines
+		entry += " " + line
+		depth += strings.Count(line, "(") - strings.Count(line, ")")
+		if depth > 0 {
+			continue
+		}
+		// a record starting with whitespace belongs to the previous name
+		continued := entry[1] == ' ' || entry[1] == '\t'
+		fields, err := tokenize(strings.NewReplacer("(", " ", ")", " ").Replace(entry))
+		entry = ""
+		if err != nil {
+			return nil, fmt.Errorf("zone line %d: %s", n, err)
+		}
+
+		if fields[0] == "$ORIGIN" {
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("zone line %d: invalid $ORIGIN", n)
+			}
+			origin = absolute(fields[1], "")
+			continue
+		}
+		if strings.HasPrefix(fields[0], "$") {
+			continue
+		}
+
+		name := last
+		if !continued {
+			name, fields = absolute(fields[0], origin), fields[1:]
+		}
+		last = name
+		if err := z.add(name, origin, fields); err != nil {
+			return nil, fmt.Errorf("zone line %d: %s", n, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return z, nil
+}
+
+func (z *Zone) add(name, origin string, fields []string) error {
+	// skip the optional TTL and class
+	for len(fields) > 0 {
+		if _, err := strconv.Atoi(fields[0]); err == nil || fields[0] == "IN" {
+			fields = fields[1:]
+			continue
+		}
+		break
+	}
+	if len(fields) < 2 {
+		return errors.New("record requires a type and data")
+	}
+
+	switch typ, rdata := strings.ToUpper(fields[0]), fields[1:]; typ {
+	case "TXT":
+		z.txt[name] = append(z.txt[name], strings.Join(rdata, ""))
+	case "A", "AAAA":
+		ip := net.ParseIP(rdata[0])
+		if ip == nil {
+			return errors.New("invalid address: " + rdata[0])
+		}
+		z.ip[name] = append(z.ip[name], ip)
+	case "MX":
+		if len(rdata) != 2 {
+			return errors.New("MX record requires a preference and host")
+		}
+		pref, err := strconv.ParseUint(rdata[0], 10, 16)
+		if err != nil {
+			return err
+		}
+		z.mx[name] = append(z.mx[name], &net.MX{Host: absolute(rdata[1], origin), Pref: uint16(pref)})
+	}
+	return nil
+}
+
+// stripComment removes a comment starting with a semicolon outside quotes
+func stripComment(line string) string {
+	quoted := false
+	for i, c := range line {
+		switch {
+		case c == '"' && (i == 0 || line[i-1] != '\\'):
+			quoted = !quoted
+		case c == ';' && !quoted:
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// tokenize splits a record into fields, a quoted string is a single field
+// without its quotes
+func tokenize(s string) ([]string, error) {
+	var fields []string
+	for s = strings.TrimSpace(s); len(s) > 0; s = strings.TrimSpace(s) {
+		if s[0] != '"' {
+			i := strings.IndexAny(s, " \t")
+			if i < 0 {
+				i = len(s)
+			}
+			fields = append(fields, s[:i])
+			s = s[i:]
+			continue
+		}
+
+		var b strings.Builder
+		i := 1
+		for ; i < len(s) && s[i] != '"'; i++ {
+			if s[i] == '\\' && i+1 < len(s) {
+				i++
+			}
+			b.WriteByte(s[i])
+		}
+		if i == len(s) {
+			return nil, errors.New("unterminated string")
+		}
+		fields = append(fields, b.String())
+		s = s[i+1:]
+	}
+	if len(fields) == 0 {
+		return nil, errors.New("empty record")
+	}
+	return fields, nil
+}
+
+// absolute returns a lower case fully qualified name without the trailing dot
+func absolute(name, origin string) string {
+	name = strings.ToLower(name)
+	switch {
+	case name == "@":
+		return origin
+	case strings.HasSuffix(name, "."):
+		return strings.TrimSuffix(name, ".")
+	case len(origin) > 0:
+		return name + "." + origin
+	}
+	return name
+}
+
+func key(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// LookupTXT implements Resolver
+func (z *Zone) LookupTXT(name string) ([]string, error) {
+	if txt, ok := z.txt[key(name)]; ok {
+		return txt, nil
+	}
+	return nil, ErrNotFound
+}
+
+// LookupIP implements Resolver
+func (z *Zone) LookupIP(host string) ([]net.IP, error) {
+	if ips, ok := z.ip[key(host)]; ok {
+		return ips, nil
+	}
+	return nil, ErrNotFound
+}
+
+// LookupMX implements Resolver
+func (z *Zone) LookupMX(name string) ([]*net.MX, error) {
+	if mx, ok := z.mx[key(name)]; ok {
+		return mx, nil
+	}
+	return nil, ErrNotFound
+}
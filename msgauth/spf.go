@@ -0,0 +1,349 @@
+package msgauth
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// maxSPFLookups limits the mechanisms and modifiers causing DNS lookups
+// while evaluating a record, including those of included records
+const maxSPFLookups = 10
+
+// SPFResult is the evaluation of the SPF record of the sender's domain
+type SPFResult struct {
+	Result string `json:"result"`
+	// Domain is the domain of the MAIL FROM address, or the HELO name for
+	// the null sender
+	Domain string `json:"domain,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// spfCheck holds the state of an SPF evaluation
+type spfCheck struct {
+	resolver Resolver
+	ip       net.IP
+	sender   string
+	helo     string
+	lookups  int
+}
+
+// checkSPF evaluates the SPF record of the domain of the sender, or of the
+// HELO name for the null sender
+func checkSPF(resolver Resolver, ip net.IP, helo, sender string) SPFResult {
+	if len(sender) == 0 {
+		sender = "postmaster@" + helo
+	}
+	domain := sender
+	if i := strings.LastIndex(sender, "@"); i >= 0 {
+		domain = sender[i+1:]
+	}
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if ip == nil || len(domain) == 0 {
+		return SPFResult{Result: None, Domain: domain}
+	}
+
+	c := &spfCheck{resolver: resolver, ip: ip, sender: sender, helo: helo}
+	result, err := c.check(domain)
+	res := SPFResult{Result: result, Domain: domain}
+	if err != nil {
+		res.Error = err.Error()
+	}
+	return res
+}
+
+// record returns the SPF record of a domain, or an empty string if it
+// has none
+func (c *spfCheck) record(domain string) (string, error) {
+	txt, err := c.resolver.LookupTXT(domain)
+	if isNotFound(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", &resultError{TempError, err.Error()}
+	}
+
+	var record string
+	for _, t := range txt {
+		if t == "v=spf1" || strings.HasPrefix(t, "v=spf1 ") {
+			if len(record) > 0 {
+				return "", permError("multiple SPF records for " + domain)
+			}
+			record = t
+		}
+	}
+	return record, nil
+}
+
+func (c *spfCheck) check(domain string) (string, error) {
+	record, err := c.record(domain)
+	if err != nil {
+		return err.(*resultError).result, err
+	}
+	if len(record) == 0 {
+		return None, nil
+	}
+
+	var redirect string
+	for _, term := range strings.Fields(record)[1:] {
+		// modifiers
+		if i := strings.Index(term, "="); i > 0 && !strings.ContainsAny(term[:i], ":/") {
+			if strings.EqualFold(term[:i], "redirect") {
+				redirect = term[i+1:]
+			}
+			continue
+		}
+
+		qualifier := Pass
+		switch term[0] {
+		case '+':
+			term = term[1:]
+		case '-':
+			qualifier, term = Fail, term[1:]
+		case '~':
+			qualifier, term = SoftFail, term[1:]
+		case '?':
+			qualifier, term = Neutral, term[1:]
+		}
+
+		match, err := c.mechanism(term, domain)
+		if err != nil {
+			if e, ok := err.(*resultError); ok {
+				return e.result, err
+			}
+			return PermError, err
+		}
+		if match {
+			return qualifier, nil
+		}
+	}
+
+	if len(redirect) > 0 {
+		if err := c.lookup(); err != nil {
+			return PermError, err
+		}
+		target, err := c.expand(redirect, domain)
+		if err != nil {
+			return PermError, err
+		}
+		result, err := c.check(target)
+		if result == None {
+			return PermError, errors.New("redirect to " + target + " without an SPF record")
+		}
+		return result, err
+	}
+	return Neutral, nil
+}
+
+// lookup counts a term causing DNS lookups
+func (c *spfCheck) lookup() error {
+	c.lookups++
+	if c.lookups > maxSPFLookups {
+		return permError("too many DNS lookups")
+	}
+	return nil
+}
+
+// mechanism returns true if the IP matches a mechanism
+func (c *spfCheck) mechanism(term, domain string) (bool, error) {
+	name, arg := term, ""
+	if i := strings.IndexAny(term, ":/"); i >= 0 {
+		name, arg = term[:i], term[i:]
+	}
+	name = strings.ToLower(name)
+
+	switch name {
+	case "all":
+		return true, nil
+	case "ip4", "ip6":
+		if !strings.HasPrefix(arg, ":") {
+			return false, permError(name + " requires an address")
+		}
+		return c.matchCIDR(arg[1:], name == "ip6")
+	case "include", "exists", "a", "mx", "ptr":
+		if (name == "include" || name == "exists") && !strings.HasPrefix(arg, ":") {
+			return false, permError(name + " requires a domain")
+		}
+		if err := c.lookup(); err != nil {
+			return false, err
+		}
+	default:
+		return false, permError("unknown mechanism " + name)
+	}
+
+	// the remaining mechanisms take an optional domain and CIDR lengths
+	target, cidr4, cidr6 := domain, 32, 128
+	if strings.HasPrefix(arg, ":") {
+		arg = arg[1:]
+		spec := arg
+		if i := strings.Index(arg, "/"); i >= 0 {
+			spec, arg = arg[:i], arg[i:]
+		} else {
+			arg = ""
+		}
+		var err error
+		if target, err = c.expand(spec, domain); err != nil {
+			return false, err
+		}
+	}
+	if len(arg) > 0 {
+		var err error
+		if cidr4, cidr6, err = parseDualCIDR(arg); err != nil {
+			return false, err
+		}
+	}
+
+	switch name {
+	case "include":
+		result, err := c.check(target)
+		switch result {
+		case Pass:
+			return true, nil
+		case Fail, SoftFail, Neutral:
+			return false, nil
+		case TempError:
+			return false, err
+		}
+		msg := "include of " + target + " without an SPF record"
+		if err != nil {
+			msg = err.Error()
+		}
+		return false, permError(msg)
+	case "exists":
+		ips, err := c.resolver.LookupIP(target)
+		if err != nil && !isNotFound(err) {
+			return false, &resultError{TempError, err.Error()}
+		}
+		return len(ips) > 0, nil
+	case "a":
+		return c.matchHost(target, cidr4, cidr6)
+	case "mx":
+		mx, err := c.resolver.LookupMX(target)
+		if err != nil && !isNotFound(err) {
+			return false, &resultError{TempError, err.Error()}
+		}
+		for _, m := range mx {
+			if ok, err := c.matchHost(strings.TrimSuffix(m.Host, "."), cidr4, cidr6); ok || err != nil {
+				return ok, err
+			}
+		}
+		return false, nil
+	}
+	// ptr is deprecated, and never matches
+	return false, nil
+}
+
+func (c *spfCheck) matchHost(host string, cidr4, cidr6 int) (bool, error) {
+	ips, err := c.resolver.LookupIP(host)
+	if err != nil && !isNotFound(err) {
+		return false, &resultError{TempError, err.Error()}
+	}
+	for _, ip := range ips {
+		bits, ones := 128, cidr6
+		if ip.To4() != nil {
+			bits, ones = 32, cidr4
+		}
+		network := &net.IPNet{IP: ip.Mask(net.CIDRMask(ones, bits)), Mask: net.CIDRMask(ones, bits)}
+		if network.Contains(c.ip) && (ip.To4() != nil) == (c.ip.To4() != nil) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (c *spfCheck) matchCIDR(spec string, ip6 bool) (bool, error) {
+	if !strings.Contains(spec, "/") {
+		if ip6 {
+			spec += "/128"
+		} else {
+			spec += "/32"
+		}
+	}
+	_, network, err := net.ParseCIDR(spec)
+	if err != nil || (network.IP.To4() != nil) == ip6 {
+		return false, permError("invalid network " + spec)
+	}
+	if (c.ip.To4() != nil) == ip6 {
+		return false, nil
+	}
+	return network.Contains(c.ip), nil
+}
+
+// parseDualCIDR parses CIDR lengths such as /24, //64 or /24//64
+func parseDualCIDR(s string) (int, int, error) {
+	cidr4, cidr6 := 32, 128
+	parts := strings.SplitN(s, "//", 2)
+	var err error
+	if len(parts[0]) > 0 {
+		if cidr4, err = strconv.Atoi(strings.TrimPrefix(parts[0], "/")); err != nil || cidr4 < 0 || cidr4 > 32 {
+			return 0, 0, permError("invalid CIDR length " + s)
+		}
+	}
+	if len(parts) == 2 {
+		if cidr6, err = strconv.Atoi(parts[1]); err != nil || cidr6 < 0 || cidr6 > 128 {
+			return 0, 0, permError("invalid CIDR length " + s)
+		}
+	}
+	return cidr4, cidr6, nil
+}
+
+// expand replaces the macros of a domain spec, transformers aren't supported
+func (c *spfCheck) expand(spec, domain string) (string, error) {
+	if !strings.Contains(spec, "%") {
+		return spec, nil
+	}
+
+	local, senderDomain := "postmaster", domain
+	if i := strings.LastIndex(c.sender, "@"); i >= 0 {
+		if i > 0 {
+			local = c.sender[:i]
+		}
+		senderDomain = c.sender[i+1:]
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(spec); i++ {
+		if spec[i] != '%' {
+			b.WriteByte(spec[i])
+			continue
+		}
+		if i+1 == len(spec) {
+			return "", permError("invalid macro in " + spec)
+		}
+		i++
+		switch spec[i] {
+		case '%':
+			b.WriteByte('%')
+		case '_':
+			b.WriteByte(' ')
+		case '-':
+			b.WriteString("%20")
+		case '{':
+			end := strings.Index(spec[i:], "}")
+			if end != 2 {
+				return "", permError("unsupported macro in " + spec)
+			}
+			switch spec[i+1] {
+			case 's':
+				b.WriteString(c.sender)
+			case 'l':
+				b.WriteString(local)
+			case 'o':
+				b.WriteString(senderDomain)
+			case 'd':
+				b.WriteString(domain)
+			case 'i':
+				b.WriteString(c.ip.String())
+			case 'h':
+				b.WriteString(c.helo)
+			default:
+				return "", permError("unsupported macro in " + spec)
+			}
+			i += end
+		default:
+			return "", permError("invalid macro in " + spec)
+		}
+	}
+	return b.String(), nil
+}
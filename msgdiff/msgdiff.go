@@ -0,0 +1,247 @@
+// Package msgdiff compares the headers and decoded text and HTML of
+// messages, optionally normalizing the fields which change between
+// otherwise identical messages.
+package msgdiff
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/jay-dee7/MailHog-Server/mimetree"
+	"github.com/mailhog/data"
+)
+
+// Placeholders replacing volatile values when normalizing
+const (
+	placeholderDate      = "<date>"
+	placeholderMessageID = "<message-id>"
+	placeholderBoundary  = "<boundary>"
+	placeholderIgnored   = "<ignored>"
+)
+
+// maxDiffCells limits the size of the line diff table, larger texts which
+// differ are reported as replaced entirely
+const maxDiffCells = 4 << 20
+
+// Rendition is the comparable content of a message
+type Rendition struct {
+	Headers map[string][]string `json:"headers"`
+	Text    string              `json:"text"`
+	HTML    string              `json:"html"`
+}
+
+// Render extracts the headers and the decoded text and HTML parts of a message
+func Render(message *data.Message) (*Rendition, error) {
+	tree, err := mimetree.Parse(mimetree.Raw(message))
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Rendition{Headers: make(map[string][]string)}
+	for k, v := range tree.Header {
+		r.Headers[k] = append([]string(nil), v...)
+	}
+	if p := findPart(tree, "text/plain"); p != nil {
+		if r.Text, err = p.Text(); err != nil {
+			return nil, err
+		}
+	}
+	if p := findPart(tree, "text/html"); p != nil {
+		if r.HTML, err = p.Text(); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+func findPart(tree *mimetree.Part, contentType string) *mimetree.Part {
+	var found *mimetree.Part
+	tree.Walk(func(p *mimetree.Part) {
+		if found == nil && p.ContentType == contentType && !p.IsAttachment() {
+			found = p
+		}
+	})
+	return found
+}
+
+var boundaryRegexp = regexp.MustCompile(`(?i)(boundary=)("[^"]*"|[^;\s]+)`)
+
+// Normalize replaces the values which change for every message: the Date
+// and Message-ID headers, multipart boundaries and Received headers, which
+// are removed. Text matching any of the ignore expressions is replaced too.
+func (r *Rendition) Normalize(ignore []*regexp.Regexp) {
+	delete(r.Headers, "Received")
+	for k, values := range r.Headers {
+		for i, v := range values {
+			switch k {
+			case "Date":
+				values[i] = placeholderDate
+			case "Message-Id":
+				values[i] = placeholderMessageID
+			case "Content-Type":
+				values[i] = boundaryRegexp.ReplaceAllString(v, "${1}"+placeholderBoundary)
+			}
+		}
+	}
+	r.Ignore(ignore)
+}
+
+// Ignore replaces the text matching any of the ignore expressions in the
+// headers and bodies
+func (r *Rendition) Ignore(ignore []*regexp.Regexp) {
+	for _, values := range r.Headers {
+		for i, v := range values {
+			values[i] = replaceAll(v, ignore)
+		}
+	}
+	r.Text = replaceAll(r.Text, ignore)
+	r.HTML = replaceAll(r.HTML, ignore)
+}
+
+func replaceAll(s string, ignore []*regexp.Regexp) string {
+	for _, re := range ignore {
+		s = re.ReplaceAllString(s, placeholderIgnored)
+	}
+	return s
+}
+
+// HeaderDiff is a header whose values differ
+type HeaderDiff struct {
+	Name     string   `json:"name"`
+	Expected []string `json:"expected"`
+	Actual   []string `json:"actual"`
+}
+
+// Line diff operations
+const (
+	Removed = "-"
+	Added   = "+"
+)
+
+// Line is a line which was removed from the expected text or added to the
+// actual text. Line numbers start at 1, and are 0 for the other side.
+type Line struct {
+	Op       string `json:"op"`
+	Expected int    `json:"expected"`
+	Actual   int    `json:"actual"`
+	Text     string `json:"text"`
+}
+
+// Result is the difference between two renditions
+type Result struct {
+	Equal   bool         `json:"equal"`
+	Headers []HeaderDiff `json:"headers"`
+	Text    []Line       `json:"text"`
+	HTML    []Line       `json:"html"`
+}
+
+// Compare returns the differences from the expected to the actual rendition
+func Compare(expected, actual *Rendition) Result {
+	res := Result{
+		Headers: diffHeaders(expected.Headers, actual.Headers),
+		Text:    diffLines(expected.Text, actual.Text),
+		HTML:    diffLines(expected.HTML, actual.HTML),
+	}
+	res.Equal = len(res.Headers) == 0 && len(res.Text) == 0 && len(res.HTML) == 0
+	return res
+}
+
+func diffHeaders(expected, actual map[string][]string) []HeaderDiff {
+	names := make(map[string]bool)
+	for k := range expected {
+		names[k] = true
+	}
+	for k := range actual {
+		names[k] = true
+	}
+
+	diffs := []HeaderDiff{}
+	for k := range names {
+		if !equal(expected[k], actual[k]) {
+			diffs = append(diffs, HeaderDiff{Name: k, Expected: expected[k], Actual: actual[k]})
+		}
+	}
+	sort.Slice(diffs, func(i, j int) bool { return diffs[i].Name < diffs[j].Name })
+	return diffs
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func splitLines(s string) []string {
+	if len(s) == 0 {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(strings.Replace(s, "\r\n", "\n", -1), "\n"), "\n")
+}
+
+// diffLines returns the lines removed and added between two texts, using
+// the longest common subsequence of their lines
+func diffLines(expected, actual string) []Line {
+	a, b := splitLines(expected), splitLines(actual)
+
+	// the common prefix and suffix don't need the table
+	pre := 0
+	for pre < len(a) && pre < len(b) && a[pre] == b[pre] {
+		pre++
+	}
+	suf := 0
+	for suf < len(a)-pre && suf < len(b)-pre && a[len(a)-1-suf] == b[len(b)-1-suf] {
+		suf++
+	}
+	am, bm := a[pre:len(a)-suf], b[pre:len(b)-suf]
+
+	lines := []Line{}
+	if len(am)*len(bm) > maxDiffCells {
+		for i, l := range am {
+			lines = append(lines, Line{Op: Removed, Expected: pre + i + 1, Text: l})
+		}
+		for j, l := range bm {
+			lines = append(lines, Line{Op: Added, Actual: pre + j + 1, Text: l})
+		}
+		return lines
+	}
+
+	// lcs[i][j] is the length of the common subsequence of am[i:] and bm[j:]
+	lcs := make([][]int32, len(am)+1)
+	for i := range lcs {
+		lcs[i] = make([]int32, len(bm)+1)
+	}
+	for i := len(am) - 1; i >= 0; i-- {
+		for j := len(bm) - 1; j >= 0; j-- {
+			if am[i] == bm[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	i, j := 0, 0
+	for i < len(am) || j < len(bm) {
+		switch {
+		case i < len(am) && j < len(bm) && am[i] == bm[j]:
+			i++
+			j++
+		case j == len(bm) || (i < len(am) && lcs[i+1][j] >= lcs[i][j+1]):
+			lines = append(lines, Line{Op: Removed, Expected: pre + i + 1, Text: am[i]})
+			i++
+		default:
+			lines = append(lines, Line{Op: Added, Actual: pre + j + 1, Text: bm[j]})
+			j++
+		}
+	}
+	return lines
+}
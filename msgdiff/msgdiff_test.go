@@ -0,0 +1,70 @@
+package msgdiff
+
+import (
+	"regexp"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/mailhog/data"
+)
+
+func message(id, date, token string) *data.Message {
+	return &data.Message{Raw: &data.SMTPMessage{Data: "Subject: Welcome\r\n" +
+		"Date: " + date + "\r\n" +
+		"Message-ID: <" + id + "@shop.example>\r\n" +
+		"Content-Type: multipart/alternative; boundary=" + id + "\r\n" +
+		"\r\n" +
+		"--" + id + "\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"Hello\r\nConfirm with " + token + "\r\nBye\r\n" +
+		"--" + id + "\r\n" +
+		"Content-Type: text/html\r\n" +
+		"\r\n" +
+		"<p>Hello</p>\r\n" +
+		"--" + id + "--\r\n"}}
+}
+
+func TestCompare(t *testing.T) {
+	Convey("Normalized renditions of the same template should be equal", t, func() {
+		ignore := []*regexp.Regexp{regexp.MustCompile(`token-\w+`)}
+
+		a, err := Render(message("a1", "Mon, 19 Oct 2026 10:00:00 +0000", "token-abc"))
+		So(err, ShouldBeNil)
+		So(a.Text, ShouldContainSubstring, "Confirm with token-abc")
+		So(a.HTML, ShouldContainSubstring, "<p>Hello</p>")
+
+		b, err := Render(message("b2", "Tue, 20 Oct 2026 10:00:00 +0000", "token-def"))
+		So(err, ShouldBeNil)
+
+		So(Compare(a, b).Equal, ShouldBeFalse)
+
+		a.Normalize(ignore)
+		b.Normalize(ignore)
+		So(Compare(a, b).Equal, ShouldBeTrue)
+	})
+
+	Convey("Ignored text should be replaced without normalizing", t, func() {
+		ignore := []*regexp.Regexp{regexp.MustCompile(`token-\w+`)}
+
+		a, _ := Render(message("a1", "Mon, 19 Oct 2026 10:00:00 +0000", "token-abc"))
+		a.Ignore(ignore)
+		So(a.Text, ShouldContainSubstring, "Confirm with "+placeholderIgnored)
+		So(a.Headers["Date"], ShouldResemble, []string{"Mon, 19 Oct 2026 10:00:00 +0000"})
+	})
+
+	Convey("Changed lines and headers should be reported", t, func() {
+		a := &Rendition{Headers: map[string][]string{"Subject": {"Welcome"}}, Text: "Hello\nworld\nBye\n"}
+		b := &Rendition{Headers: map[string][]string{"Subject": {"Welcome!"}}, Text: "Hello\nthere\nBye\n"}
+
+		res := Compare(a, b)
+		So(res.Equal, ShouldBeFalse)
+		So(res.Headers, ShouldResemble, []HeaderDiff{{Name: "Subject", Expected: []string{"Welcome"}, Actual: []string{"Welcome!"}}})
+		So(res.Text, ShouldResemble, []Line{
+			{Op: Removed, Expected: 2, Text: "world"},
+			{Op: Added, Actual: 2, Text: "there"},
+		})
+		So(res.HTML, ShouldBeEmpty)
+	})
+}
@@ -0,0 +1,165 @@
+package msgdiff
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrSnapshotNotFound is returned for an unknown snapshot
+var ErrSnapshotNotFound = errors.New("snapshot not found")
+
+// Snapshot is a named golden rendition of a message, which later messages
+// are compared against
+type Snapshot struct {
+	Name string `json:"name"`
+	// MessageID is the MailHog ID of the message the snapshot was taken from
+	MessageID string `json:"messageId"`
+	// Ignore are regular expressions whose matches are ignored when comparing
+	Ignore    []string  `json:"ignore"`
+	Created   time.Time `json:"created"`
+	Rendition Rendition `json:"rendition"`
+
+	ignore []*regexp.Regexp
+}
+
+// compile validates the snapshot and compiles its regular expressions
+func (s *Snapshot) compile() error {
+	if len(s.Name) == 0 {
+		return errors.New("snapshot requires a name")
+	}
+
+	s.ignore = nil
+	for _, expr := range s.Ignore {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return err
+		}
+		s.ignore = append(s.ignore, re)
+	}
+	return nil
+}
+
+// Compare normalizes an actual rendition with the snapshot's ignore
+// expressions and returns its differences from the snapshot
+func (s *Snapshot) Compare(actual *Rendition) Result {
+	actual.Normalize(s.ignore)
+	return Compare(&s.Rendition, actual)
+}
+
+// Store holds the snapshots of each tenant
+type Store struct {
+	mu        sync.RWMutex
+	path      string
+	snapshots map[string]map[string]*Snapshot
+}
+
+// NewStore creates a snapshot store, loading the snapshots saved to path.
+// An empty path keeps the snapshots in memory only.
+func NewStore(path string) (*Store, error) {
+	s := &Store{
+		path:      path,
+		snapshots: make(map[string]map[string]*Snapshot),
+	}
+	if len(path) == 0 {
+		return s, nil
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &s.snapshots); err != nil {
+		return nil, err
+	}
+	for _, snapshots := range s.snapshots {
+		for name, snap := range snapshots {
+			snap.Name = name
+			if err := snap.compile(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return s, nil
+}
+
+// List returns the snapshots of the tenant, sorted by name
+func (s *Store) List(tenant string) []Snapshot {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	snapshots := []Snapshot{}
+	for _, snap := range s.snapshots[tenant] {
+		snapshots = append(snapshots, *snap)
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].Name < snapshots[j].Name })
+	return snapshots
+}
+
+// Get returns a snapshot of the tenant
+func (s *Store) Get(tenant, name string) (*Snapshot, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	snap, ok := s.snapshots[tenant][name]
+	if !ok {
+		return nil, false
+	}
+	c := *snap
+	return &c, true
+}
+
+// Put normalizes the rendition of a snapshot and adds or replaces it
+func (s *Store) Put(tenant string, snap Snapshot) (*Snapshot, error) {
+	if err := snap.compile(); err != nil {
+		return nil, err
+	}
+	snap.Rendition.Normalize(snap.ignore)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.snapshots[tenant]; !ok {
+		s.snapshots[tenant] = make(map[string]*Snapshot)
+	}
+	s.snapshots[tenant][snap.Name] = &snap
+	return &snap, s.save()
+}
+
+// Delete removes a snapshot of the tenant
+func (s *Store) Delete(tenant, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.snapshots[tenant][name]; !ok {
+		return ErrSnapshotNotFound
+	}
+	delete(s.snapshots[tenant], name)
+	return s.save()
+}
+
+// save persists the snapshots, the caller must hold s.mu
+func (s *Store) save() error {
+	if len(s.path) == 0 {
+		return nil
+	}
+
+	b, err := json.MarshalIndent(s.snapshots, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
@@ -0,0 +1,295 @@
+package release
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/jay-dee7/MailHog-Server/mimetree"
+	"github.com/mailhog/data"
+)
+
+// ErrInvalidRule is returned for an auto-release rule without a server or
+// without a condition, which would release every message
+var ErrInvalidRule = errors.New("rule requires a name, a server and a recipient or header condition")
+
+// ErrRuleNotFound is returned for an unknown auto-release rule
+var ErrRuleNotFound = errors.New("rule not found")
+
+// ErrInvalidOptions is returned for release options containing line breaks
+var ErrInvalidOptions = errors.New("release options can't contain line breaks")
+
+// Options control the envelope and headers of a release
+type Options struct {
+	// Recipients are released to in addition to the Email of the server
+	Recipients []string
+	// PreserveRecipients releases to the original envelope recipients
+	PreserveRecipients bool
+	// From overrides the envelope sender, nobody@hostname by default
+	From string
+	// RewriteTo replaces the To header of the released message
+	RewriteTo string
+	// SubjectPrefix is prepended to the Subject header of the released message
+	SubjectPrefix string
+}
+
+// Validate rejects options containing line breaks, which would inject
+// headers or SMTP commands into the release
+func (o *Options) Validate() error {
+	values := append([]string{o.From, o.RewriteTo, o.SubjectPrefix}, o.Recipients...)
+	for _, v := range values {
+		if strings.ContainsAny(v, "\r\n") {
+			return ErrInvalidOptions
+		}
+	}
+	return nil
+}
+
+// NewRelease builds the release of a message through a server
+func NewRelease(tenant, messageID string, msg *data.Message, server *Server, opts Options, hostname string) *Release {
+	to := opts.Recipients
+	if len(server.Email) > 0 {
+		to = append([]string{server.Email}, to...)
+	}
+	if opts.PreserveRecipients {
+		to = append(to, envelopeRecipients(msg)...)
+	}
+
+	from := opts.From
+	if len(from) == 0 {
+		from = "nobody@" + hostname
+	}
+
+	return &Release{
+		Tenant:        tenant,
+		MessageID:     messageID,
+		Server:        server,
+		From:          from,
+		To:            to,
+		RewriteTo:     opts.RewriteTo,
+		SubjectPrefix: opts.SubjectPrefix,
+	}
+}
+
+func envelopeRecipients(msg *data.Message) []string {
+	if msg.Raw != nil {
+		return msg.Raw.To
+	}
+
+	var to []string
+	for _, p := range msg.To {
+		to = append(to, p.Mailbox+"@"+p.Domain)
+	}
+	return to
+}
+
+// Rule automatically releases accepted messages matching its conditions
+// through a named server. Every condition which is set must match.
+type Rule struct {
+	Name string `json:"name"`
+	// Recipient is a regular expression matched against each envelope recipient
+	Recipient string `json:"recipient,omitempty"`
+	// Header names a header which must be present, and Value is a regular
+	// expression matched against its values if set
+	Header string `json:"header,omitempty"`
+	Value  string `json:"value,omitempty"`
+	// Server is the name of the outgoing server to release through
+	Server  string  `json:"server"`
+	Options Options `json:"options"`
+
+	recipient *regexp.Regexp
+	value     *regexp.Regexp
+}
+
+// compile validates the rule and compiles its regular expressions
+func (r *Rule) compile() error {
+	if len(r.Name) == 0 || len(r.Server) == 0 || (len(r.Recipient) == 0 && len(r.Header) == 0) {
+		return ErrInvalidRule
+	}
+	if err := r.Options.Validate(); err != nil {
+		return err
+	}
+
+	var err error
+	if r.recipient, err = compileOptional(r.Recipient); err != nil {
+		return err
+	}
+	r.value, err = compileOptional(r.Value)
+	return err
+}
+
+func compileOptional(expr string) (*regexp.Regexp, error) {
+	if len(expr) == 0 {
+		return nil, nil
+	}
+	return regexp.Compile(expr)
+}
+
+// Match returns true if the message matches every condition of the rule
+func (r *Rule) Match(msg *data.Message) bool {
+	if r.recipient != nil {
+		matched := false
+		for _, to := range envelopeRecipients(msg) {
+			if r.recipient.MatchString(to) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	if len(r.Header) > 0 {
+		values := mimetree.Header(msg, r.Header)
+		if len(values) == 0 {
+			return false
+		}
+		if r.value == nil {
+			return true
+		}
+		for _, v := range values {
+			if r.value.MatchString(v) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return true
+}
+
+// RuleStore holds the auto-release rules of each tenant and releases the
+// messages matching them
+type RuleStore struct {
+	mu       sync.RWMutex
+	path     string
+	rules    map[string]map[string]*Rule
+	servers  *ServerStore
+	queue    *Queue
+	hostname string
+}
+
+// NewRuleStore creates a rule store releasing through the servers and queue,
+// loading the rules saved to path. An empty path keeps the rules in memory only.
+func NewRuleStore(path string, servers *ServerStore, queue *Queue, hostname string) (*RuleStore, error) {
+	s := &RuleStore{
+		path:     path,
+		rules:    make(map[string]map[string]*Rule),
+		servers:  servers,
+		queue:    queue,
+		hostname: hostname,
+	}
+	if len(path) == 0 {
+		return s, nil
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &s.rules); err != nil {
+		return nil, err
+	}
+	for _, rules := range s.rules {
+		for name, r := range rules {
+			r.Name = name
+			if err := r.compile(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return s, nil
+}
+
+// List returns the rules of the tenant, sorted by name
+func (s *RuleStore) List(tenant string) []Rule {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rules := []Rule{}
+	for _, r := range s.rules[tenant] {
+		rules = append(rules, *r)
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].Name < rules[j].Name })
+	return rules
+}
+
+// Put validates and adds or replaces a rule of the tenant
+func (s *RuleStore) Put(tenant string, r Rule) error {
+	if err := r.compile(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.rules[tenant]; !ok {
+		s.rules[tenant] = make(map[string]*Rule)
+	}
+	s.rules[tenant][r.Name] = &r
+	return s.save()
+}
+
+// Delete removes a rule of the tenant
+func (s *RuleStore) Delete(tenant, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.rules[tenant][name]; !ok {
+		return ErrRuleNotFound
+	}
+	delete(s.rules[tenant], name)
+	return s.save()
+}
+
+// Apply queues a release for each rule of the tenant matching an accepted
+// message. Failures are logged since they mustn't affect the acceptance.
+func (s *RuleStore) Apply(tenant, messageID string, msg *data.Message) []*Release {
+	var releases []*Release
+	for _, rule := range s.List(tenant) {
+		if !rule.Match(msg) {
+			continue
+		}
+
+		server, ok := s.servers.Get(tenant, rule.Server)
+		if !ok {
+			log.Printf("[RELEASE] Auto-release rule %s uses unknown server %s", rule.Name, rule.Server)
+			continue
+		}
+		r, err := s.queue.Enqueue(NewRelease(tenant, messageID, msg, server, rule.Options, s.hostname))
+		if err != nil {
+			log.Printf("[RELEASE] Auto-release rule %s failed to queue message %s: %s", rule.Name, messageID, err)
+			continue
+		}
+		releases = append(releases, r)
+	}
+	return releases
+}
+
+// save persists the rules, the caller must hold s.mu
+func (s *RuleStore) save() error {
+	if len(s.path) == 0 {
+		return nil
+	}
+
+	b, err := json.MarshalIndent(s.rules, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
@@ -0,0 +1,365 @@
+// Package release delivers stored messages to real SMTP servers through
+// a persistent queue with retries.
+package release
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/textproto"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jay-dee7/MailHog-Server/mimetree"
+	"github.com/jay-dee7/storage"
+)
+
+// ErrNoRecipients is returned when a release has no envelope recipients
+var ErrNoRecipients = errors.New("release requires at least one recipient")
+
+// Status is the delivery status of a release
+type Status string
+
+// Release statuses
+const (
+	Pending Status = "pending"
+	Sent    Status = "sent"
+	Failed  Status = "failed"
+)
+
+// Release is a request to deliver a stored message through an outgoing server
+type Release struct {
+	ID        string   `json:"id"`
+	Tenant    string   `json:"tenant"`
+	MessageID string   `json:"messageId"`
+	Server    *Server  `json:"server"`
+	From      string   `json:"from"`
+	To        []string `json:"to"`
+
+	// RewriteTo replaces the To header of the message if set
+	RewriteTo string `json:"rewriteTo,omitempty"`
+	// SubjectPrefix is prepended to the Subject header of the message
+	SubjectPrefix string `json:"subjectPrefix,omitempty"`
+
+	Status      Status    `json:"status"`
+	Attempts    int       `json:"attempts"`
+	Error       string    `json:"error,omitempty"`
+	Created     time.Time `json:"created"`
+	Updated     time.Time `json:"updated"`
+	NextAttempt time.Time `json:"nextAttempt,omitempty"`
+}
+
+// Redacted returns a copy of the release without the secrets of its server
+func (r Release) Redacted() Release {
+	r.Server = r.Server.Redacted()
+	return r
+}
+
+func newID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Queue delivers releases in the background, retrying temporary failures
+// with an exponential backoff
+type Queue struct {
+	// MaxAttempts is the number of delivery attempts before a release fails
+	MaxAttempts int
+	// Backoff is the delay before the first retry, doubled for each retry
+	Backoff time.Duration
+	// Retention is how long finished releases are kept in the history
+	Retention time.Duration
+
+	storage  storage.MultiTenantStorage
+	path     string
+	cipher   *Cipher
+	mu       sync.Mutex
+	releases map[string]*Release
+	wake     chan struct{}
+
+	listenersMu sync.RWMutex
+	listeners   []func(Release)
+}
+
+// NewQueue creates a release queue, loading any releases persisted to path.
+// An empty path keeps the queue in memory only. The secrets of the servers
+// are encrypted in the file if cipher isn't nil. Reloaded releases through
+// a server which still matches the server file of servers are trusted again.
+func NewQueue(storage storage.MultiTenantStorage, path string, cipher *Cipher, servers *ServerStore) *Queue {
+	q := &Queue{
+		MaxAttempts: 5,
+		Backoff:     30 * time.Second,
+		Retention:   7 * 24 * time.Hour,
+		storage:     storage,
+		path:        path,
+		cipher:      cipher,
+		releases:    make(map[string]*Release),
+		wake:        make(chan struct{}, 1),
+	}
+
+	if len(path) > 0 {
+		b, err := ioutil.ReadFile(path)
+		switch {
+		case err == nil:
+			var releases []*Release
+			if err := json.Unmarshal(b, &releases); err != nil {
+				log.Fatalf("[RELEASE] Error loading queue %s: %s", path, err)
+			}
+			for _, r := range releases {
+				if err := cipher.openServer(r.Server); err != nil {
+					log.Fatalf("[RELEASE] Error loading queue %s: %s", path, err)
+				}
+				servers.restoreTrust(r.Tenant, r.Server)
+				q.releases[r.ID] = r
+			}
+		case !os.IsNotExist(err):
+			log.Fatalf("[RELEASE] Error loading queue %s: %s", path, err)
+		}
+	}
+
+	return q
+}
+
+// Subscribe registers fn to be called whenever the status of a release changes
+func (q *Queue) Subscribe(fn func(Release)) {
+	q.listenersMu.Lock()
+	defer q.listenersMu.Unlock()
+	q.listeners = append(q.listeners, fn)
+}
+
+func (q *Queue) notify(r Release) {
+	q.listenersMu.RLock()
+	defer q.listenersMu.RUnlock()
+	for _, fn := range q.listeners {
+		fn(r)
+	}
+}
+
+// Enqueue validates a release and queues it for delivery
+func (q *Queue) Enqueue(r *Release) (*Release, error) {
+	if err := r.Server.Validate(); err != nil {
+		return nil, err
+	}
+	if len(r.To) == 0 {
+		return nil, ErrNoRecipients
+	}
+
+	now := time.Now()
+	r.ID = newID()
+	r.Status = Pending
+	r.Created = now
+	r.Updated = now
+	r.NextAttempt = now
+
+	q.mu.Lock()
+	q.releases[r.ID] = r
+	q.save()
+	c := *r
+	q.mu.Unlock()
+
+	q.notify(c)
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return &c, nil
+}
+
+// History returns the releases of a message, oldest first
+func (q *Queue) History(tenant, messageID string) []Release {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	history := []Release{}
+	for _, r := range q.releases {
+		if r.Tenant == tenant && r.MessageID == messageID {
+			history = append(history, *r)
+		}
+	}
+	sort.Slice(history, func(i, j int) bool { return history[i].Created.Before(history[j].Created) })
+	return history
+}
+
+// Start runs the delivery loop in the background
+func (q *Queue) Start() {
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		for {
+			select {
+			case <-ticker.C:
+			case <-q.wake:
+			}
+			for _, r := range q.due() {
+				q.attempt(r)
+			}
+		}
+	}()
+}
+
+// due returns copies of the releases ready for a delivery attempt and
+// prunes expired history
+func (q *Queue) due() []Release {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	var due []Release
+	for id, r := range q.releases {
+		switch {
+		case r.Status == Pending && !r.NextAttempt.After(now):
+			due = append(due, *r)
+		case r.Status != Pending && now.Sub(r.Updated) > q.Retention:
+			delete(q.releases, id)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i].Created.Before(due[j].Created) })
+	return due
+}
+
+func (q *Queue) attempt(r Release) {
+	err := q.deliver(&r)
+
+	r.Attempts++
+	r.Updated = time.Now()
+	switch {
+	case err == nil:
+		log.Printf("[RELEASE] Released message %s to %v", r.MessageID, r.To)
+		r.Status = Sent
+		r.Error = ""
+	case isPermanent(err) || r.Attempts >= q.MaxAttempts:
+		log.Printf("[RELEASE] Failed to release message %s: %s", r.MessageID, err)
+		r.Status = Failed
+		r.Error = err.Error()
+	default:
+		log.Printf("[RELEASE] Failed to release message %s, retrying: %s", r.MessageID, err)
+		r.Error = err.Error()
+		r.NextAttempt = r.Updated.Add(q.Backoff << uint(r.Attempts-1))
+	}
+
+	q.mu.Lock()
+	q.releases[r.ID] = &r
+	q.save()
+	q.mu.Unlock()
+
+	q.notify(r)
+}
+
+func (q *Queue) deliver(r *Release) error {
+	msg, err := q.storage.Load(r.MessageID, r.Tenant)
+	if err != nil {
+		return err
+	}
+	raw := rewriteHeaders(mimetree.Raw(msg), r.RewriteTo, r.SubjectPrefix)
+	return r.Server.Send(r.From, r.To, raw)
+}
+
+// rewriteHeaders replaces the To header and prefixes the Subject header of
+// a raw message, leaving every other header untouched. Headers which are
+// rewritten but missing from the message are added.
+func rewriteHeaders(raw []byte, to, subjectPrefix string) []byte {
+	if len(to) == 0 && len(subjectPrefix) == 0 {
+		return raw
+	}
+
+	end := bytes.Index(raw, []byte("\r\n\r\n"))
+	if end < 0 {
+		end = len(raw)
+	}
+
+	var out bytes.Buffer
+	var hasTo, hasSubject, skip bool
+	for _, line := range strings.Split(string(raw[:end]), "\r\n") {
+		// a message without a body may end its header with a line break,
+		// the headers which are added must still come before it
+		if len(line) == 0 {
+			continue
+		}
+		// continuation lines belong to the previous header
+		if strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t") {
+			if !skip {
+				out.WriteString(line + "\r\n")
+			}
+			continue
+		}
+		skip = false
+
+		// lines without a colon aren't headers and are passed through
+		colon := strings.Index(line, ":")
+		if colon < 0 {
+			out.WriteString(line + "\r\n")
+			continue
+		}
+		name := strings.ToLower(strings.TrimSpace(line[:colon]))
+		switch {
+		case name == "to" && len(to) > 0:
+			hasTo, skip = true, true
+			out.WriteString("To: " + to + "\r\n")
+			continue
+		case name == "subject" && len(subjectPrefix) > 0:
+			hasSubject = true
+			line = line[:colon+1] + " " + subjectPrefix + " " + strings.TrimLeft(line[colon+1:], " ")
+		}
+		out.WriteString(line + "\r\n")
+	}
+	if len(to) > 0 && !hasTo {
+		out.WriteString("To: " + to + "\r\n")
+	}
+	if len(subjectPrefix) > 0 && !hasSubject {
+		out.WriteString("Subject: " + subjectPrefix + "\r\n")
+	}
+
+	if end < len(raw) {
+		out.Write(raw[end+2:])
+	} else {
+		out.WriteString("\r\n")
+	}
+	return out.Bytes()
+}
+
+// isPermanent returns true for errors which won't go away by retrying,
+// i.e. 5xx SMTP replies and configuration errors
+func isPermanent(err error) bool {
+	if err == ErrInvalidMechanism || err == ErrInvalidTLSMode || err == ErrSTARTTLSUnsupported {
+		return true
+	}
+	if e, ok := err.(*textproto.Error); ok {
+		return e.Code >= 500
+	}
+	return false
+}
+
+// save persists the queue, the caller must hold q.mu
+func (q *Queue) save() {
+	if len(q.path) == 0 {
+		return
+	}
+
+	releases := make([]*Release, 0, len(q.releases))
+	for _, r := range q.releases {
+		c := *r
+		c.Server = q.cipher.sealServer(r.Server)
+		releases = append(releases, &c)
+	}
+	b, err := json.Marshal(releases)
+	if err != nil {
+		log.Printf("[RELEASE] Error saving queue: %s", err)
+		return
+	}
+
+	tmp := q.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		log.Printf("[RELEASE] Error saving queue: %s", err)
+		return
+	}
+	if err := os.Rename(tmp, q.path); err != nil {
+		log.Printf("[RELEASE] Error saving queue: %s", err)
+	}
+}
@@ -0,0 +1,129 @@
+package release
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// Prefixes of secret values
+const (
+	// secretEncrypted marks a value encrypted by a Cipher
+	secretEncrypted = "enc:"
+	// secretEnv references an environment variable
+	secretEnv = "env:"
+	// secretFile references a file, trailing whitespace is trimmed
+	secretFile = "file:"
+)
+
+// ErrNoKey is returned when decrypting a secret without an encryption key
+var ErrNoKey = errors.New("encrypted secret found but no encryption key is configured")
+
+// Cipher encrypts secrets stored at rest. A nil Cipher stores them as is.
+type Cipher struct {
+	aead cipher.AEAD
+}
+
+// NewCipher creates a cipher from a passphrase, or returns nil if it's empty
+func NewCipher(key string) *Cipher {
+	if len(key) == 0 {
+		return nil
+	}
+	k := sha256.Sum256([]byte(key))
+	block, _ := aes.NewCipher(k[:])
+	aead, _ := cipher.NewGCM(block)
+	return &Cipher{aead: aead}
+}
+
+// Seal encrypts a secret. Empty values and references to environment
+// variables or files are returned unchanged.
+func (c *Cipher) Seal(v string) string {
+	if c == nil || len(v) == 0 || isReference(v) || strings.HasPrefix(v, secretEncrypted) {
+		return v
+	}
+	nonce := make([]byte, c.aead.NonceSize())
+	_, _ = rand.Read(nonce)
+	return secretEncrypted + base64.StdEncoding.EncodeToString(c.aead.Seal(nonce, nonce, []byte(v), nil))
+}
+
+// Open decrypts a secret sealed by Seal, other values are returned unchanged
+func (c *Cipher) Open(v string) (string, error) {
+	if !strings.HasPrefix(v, secretEncrypted) {
+		return v, nil
+	}
+	if c == nil {
+		return "", ErrNoKey
+	}
+	b, err := base64.StdEncoding.DecodeString(v[len(secretEncrypted):])
+	if err != nil {
+		return "", err
+	}
+	n := c.aead.NonceSize()
+	if len(b) < n {
+		return "", errors.New("invalid encrypted secret")
+	}
+	p, err := c.aead.Open(nil, b[:n], b[n:], nil)
+	if err != nil {
+		return "", errors.New("unable to decrypt secret, is the encryption key correct?")
+	}
+	return string(p), nil
+}
+
+func isReference(v string) bool {
+	return strings.HasPrefix(v, secretEnv) || strings.HasPrefix(v, secretFile)
+}
+
+// resolveSecret returns the value referenced by an env: or file: secret,
+// other values are returned unchanged
+func resolveSecret(v string) (string, error) {
+	switch {
+	case strings.HasPrefix(v, secretEnv):
+		name := v[len(secretEnv):]
+		s, ok := os.LookupEnv(name)
+		if !ok {
+			return "", errors.New("secret environment variable not set: " + name)
+		}
+		return s, nil
+	case strings.HasPrefix(v, secretFile):
+		b, err := ioutil.ReadFile(v[len(secretFile):])
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(b), "\r\n"), nil
+	}
+	return v, nil
+}
+
+// sealServer returns a copy of the server with its secrets encrypted
+func (c *Cipher) sealServer(s *Server) *Server {
+	if s == nil {
+		return nil
+	}
+	cp := *s
+	cp.Password = c.Seal(s.Password)
+	cp.TLSClientKey = c.Seal(s.TLSClientKey)
+	return &cp
+}
+
+// openServer decrypts the secrets of a server in place
+func (c *Cipher) openServer(s *Server) error {
+	if s == nil {
+		return nil
+	}
+	p, err := c.Open(s.Password)
+	if err != nil {
+		return err
+	}
+	k, err := c.Open(s.TLSClientKey)
+	if err != nil {
+		return err
+	}
+	s.Password, s.TLSClientKey = p, k
+	return nil
+}
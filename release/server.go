@@ -0,0 +1,299 @@
+package release
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// ErrInvalidMechanism is returned for an unsupported authentication mechanism
+var ErrInvalidMechanism = errors.New("invalid authentication mechanism")
+
+// ErrInvalidTLSMode is returned for an unsupported TLS mode
+var ErrInvalidTLSMode = errors.New("invalid TLS mode")
+
+// ErrUntrustedServer is returned for a server received through the API which
+// uses a setting only allowed in the server file
+var ErrUntrustedServer = errors.New("passwords can't reference secrets and TLS certificates and keys must be PEM encoded")
+
+// ErrSTARTTLSUnsupported is returned when STARTTLS is required but the
+// server doesn't offer it
+var ErrSTARTTLSUnsupported = errors.New("server does not support STARTTLS")
+
+// TLS modes of an outgoing server
+const (
+	// TLSOpportunistic upgrades the connection if the server offers STARTTLS
+	TLSOpportunistic = ""
+	// TLSNone never upgrades the connection
+	TLSNone = "none"
+	// TLSStartTLS requires the connection to be upgraded with STARTTLS
+	TLSStartTLS = "starttls"
+	// TLSImplicit connects with TLS from the start, usually on port 465
+	TLSImplicit = "implicit"
+)
+
+// dialTimeout limits how long connecting to an outgoing server may take
+const dialTimeout = 30 * time.Second
+
+// Server is an outgoing SMTP server config
+type Server struct {
+	Name     string
+	Save     bool
+	Email    string
+	Host     string
+	Port     string
+	Username string
+	// Password is the password. Servers from the server file may also
+	// reference it, env:NAME reads an environment variable and file:PATH
+	// reads a file.
+	Password  string
+	Mechanism string
+
+	// TLS is one of none, starttls or implicit. If empty the connection
+	// is upgraded if the server offers STARTTLS.
+	TLS           string
+	TLSSkipVerify bool
+	// TLSCACert, TLSClientCert and TLSClientKey are PEM encoded. Servers
+	// from the server file may also use the path of a PEM file.
+	TLSCACert     string
+	TLSClientCert string
+	TLSClientKey  string
+
+	// trusted is set for servers loaded from the server file, which may
+	// read environment variables and local files
+	trusted bool
+}
+
+// Auth returns the authentication to use with the server, or nil if the
+// server doesn't require authentication
+func (s *Server) Auth() (smtp.Auth, error) {
+	if len(s.Username) == 0 && len(s.Password) == 0 {
+		return nil, nil
+	}
+	password := s.Password
+	if isReference(password) {
+		if !s.trusted {
+			return nil, ErrUntrustedServer
+		}
+		var err error
+		if password, err = resolveSecret(password); err != nil {
+			return nil, err
+		}
+	}
+	switch s.Mechanism {
+	case "CRAMMD5":
+		return smtp.CRAMMD5Auth(s.Username, password), nil
+	case "PLAIN":
+		return smtp.PlainAuth("", s.Username, password, s.Host), nil
+	default:
+		return nil, ErrInvalidMechanism
+	}
+}
+
+// Redacted returns a copy of the server without its secrets. References to
+// secrets are kept since they don't reveal them.
+func (s *Server) Redacted() *Server {
+	if s == nil {
+		return nil
+	}
+	c := *s
+	if !isReference(c.Password) {
+		c.Password = ""
+	}
+	if isPEM(c.TLSClientKey) {
+		c.TLSClientKey = ""
+	}
+	return &c
+}
+
+func isPEM(v string) bool {
+	return strings.HasPrefix(strings.TrimSpace(v), "-----BEGIN")
+}
+
+// readPEM returns v if it's PEM encoded, otherwise the content of the file v
+// if the server is trusted
+func (s *Server) readPEM(v string) ([]byte, error) {
+	if isPEM(v) {
+		return []byte(v), nil
+	}
+	if !s.trusted {
+		return nil, ErrUntrustedServer
+	}
+	return ioutil.ReadFile(v)
+}
+
+// CheckInput refuses a server received through the API whose password
+// references a secret or whose TLS certificates or keys aren't PEM encoded,
+// these are only allowed in the server file.
+//
+// old is the server of the tenant which is replaced, or nil. The API doesn't
+// return secrets, so if old has the same host, the secrets which are empty
+// and the values which are unchanged are kept from old.
+func (s *Server) CheckInput(old *Server) error {
+	if old == nil || old.Host != s.Host {
+		old = &Server{}
+	}
+	s.trusted = old.trusted
+
+	inline := func(v string) bool { return len(v) == 0 || isPEM(v) }
+	fields := []struct {
+		value  *string
+		old    string
+		secret bool
+		valid  func(string) bool
+	}{
+		{&s.Password, old.Password, true, func(v string) bool { return !isReference(v) }},
+		{&s.TLSCACert, old.TLSCACert, false, inline},
+		{&s.TLSClientCert, old.TLSClientCert, false, inline},
+		{&s.TLSClientKey, old.TLSClientKey, true, inline},
+	}
+	for _, f := range fields {
+		switch {
+		case *f.value == f.old, f.secret && len(*f.value) == 0:
+			*f.value = f.old
+		case !f.valid(*f.value):
+			return ErrUntrustedServer
+		}
+	}
+	return nil
+}
+
+// TLSConfig returns the TLS config used to connect to the server
+func (s *Server) TLSConfig() (*tls.Config, error) {
+	c := &tls.Config{
+		ServerName:         s.Host,
+		InsecureSkipVerify: s.TLSSkipVerify,
+	}
+
+	if len(s.TLSCACert) > 0 {
+		b, err := s.readPEM(s.TLSCACert)
+		if err != nil {
+			return nil, err
+		}
+		c.RootCAs = x509.NewCertPool()
+		if !c.RootCAs.AppendCertsFromPEM(b) {
+			return nil, errors.New("no certificates found in CA bundle")
+		}
+	}
+
+	if len(s.TLSClientCert) > 0 || len(s.TLSClientKey) > 0 {
+		cert, err := s.readPEM(s.TLSClientCert)
+		if err != nil {
+			return nil, err
+		}
+		key, err := s.readPEM(s.TLSClientKey)
+		if err != nil {
+			return nil, err
+		}
+		pair, err := tls.X509KeyPair(cert, key)
+		if err != nil {
+			return nil, err
+		}
+		c.Certificates = []tls.Certificate{pair}
+	}
+
+	return c, nil
+}
+
+// Validate checks the authentication and TLS settings of the server
+func (s *Server) Validate() error {
+	switch s.TLS {
+	case TLSOpportunistic, TLSNone, TLSStartTLS, TLSImplicit:
+	default:
+		return ErrInvalidTLSMode
+	}
+	if _, err := s.TLSConfig(); err != nil {
+		return err
+	}
+	_, err := s.Auth()
+	return err
+}
+
+// Dial connects to the server, negotiates TLS and authenticates
+func (s *Server) Dial() (*smtp.Client, error) {
+	tlsConfig, err := s.TLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	auth, err := s.Auth()
+	if err != nil {
+		return nil, err
+	}
+
+	addr := net.JoinHostPort(s.Host, s.Port)
+	dialer := &net.Dialer{Timeout: dialTimeout}
+
+	var conn net.Conn
+	if s.TLS == TLSImplicit {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := smtp.NewClient(conn, s.Host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// querying the extensions sends EHLO, even if they aren't needed
+	hasStartTLS, _ := c.Extension("STARTTLS")
+	if s.TLS == TLSOpportunistic || s.TLS == TLSStartTLS {
+		if hasStartTLS {
+			if err = c.StartTLS(tlsConfig); err != nil {
+				c.Close()
+				return nil, err
+			}
+		} else if s.TLS == TLSStartTLS {
+			c.Close()
+			return nil, ErrSTARTTLSUnsupported
+		}
+	}
+
+	if auth != nil {
+		if err = c.Auth(auth); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// Send delivers a message through the server
+func (s *Server) Send(from string, to []string, msg []byte) error {
+	c, err := s.Dial()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if err = c.Mail(from); err != nil {
+		return err
+	}
+	for _, rcpt := range to {
+		if err = c.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(msg); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
@@ -0,0 +1,261 @@
+package release
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+)
+
+// ErrServerExists is returned when adding a server whose name is taken
+var ErrServerExists = errors.New("server already exists")
+
+// ErrServerNotFound is returned for an unknown server name
+var ErrServerNotFound = errors.New("server not found")
+
+// ErrInvalidServer is returned when a server has no name or host
+var ErrInvalidServer = errors.New("server requires a name and a host")
+
+// serverFile is the format of the outgoing SMTP server file
+type serverFile struct {
+	// Shared servers are available to every tenant
+	Shared  map[string]*Server            `json:"shared,omitempty"`
+	Tenants map[string]map[string]*Server `json:"tenants,omitempty"`
+}
+
+// ServerStore holds the outgoing SMTP servers of each tenant
+type ServerStore struct {
+	mu      sync.RWMutex
+	path    string
+	cipher  *Cipher
+	shared  map[string]*Server
+	tenants map[string]map[string]*Server
+}
+
+// NewServerStore creates a server store, loading the servers saved to path.
+// An empty path keeps the servers in memory only. Secrets are encrypted
+// in the file if cipher isn't nil.
+//
+// A file containing a plain map of servers by name, as read by earlier
+// versions, is loaded as the shared servers.
+func NewServerStore(path string, cipher *Cipher) (*ServerStore, error) {
+	s := &ServerStore{
+		path:    path,
+		cipher:  cipher,
+		shared:  make(map[string]*Server),
+		tenants: make(map[string]map[string]*Server),
+	}
+	if len(path) == 0 {
+		return s, nil
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var keys map[string]json.RawMessage
+	if err := json.Unmarshal(b, &keys); err != nil {
+		return nil, err
+	}
+	_, hasShared := keys["shared"]
+	_, hasTenants := keys["tenants"]
+
+	if len(keys) > 0 && len(keys) == btoi(hasShared)+btoi(hasTenants) {
+		var f serverFile
+		if err := json.Unmarshal(b, &f); err != nil {
+			return nil, err
+		}
+		if f.Shared != nil {
+			s.shared = f.Shared
+		}
+		if f.Tenants != nil {
+			s.tenants = f.Tenants
+		}
+	} else if err := json.Unmarshal(b, &s.shared); err != nil {
+		return nil, err
+	}
+
+	for name, srv := range s.shared {
+		srv.Name = name
+		srv.trusted = true
+		if err := cipher.openServer(srv); err != nil {
+			return nil, err
+		}
+	}
+	for _, servers := range s.tenants {
+		for name, srv := range servers {
+			srv.Name = name
+			srv.trusted = true
+			if err := cipher.openServer(srv); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return s, nil
+}
+
+func btoi(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// Get returns a copy of the named server of the tenant, falling back to
+// the shared servers
+func (s *ServerStore) Get(tenant, name string) (*Server, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	srv, ok := s.tenants[tenant][name]
+	if !ok {
+		srv, ok = s.shared[name]
+	}
+	if !ok {
+		return nil, false
+	}
+	c := *srv
+	return &c, true
+}
+
+// GetOwn returns a copy of the named server of the tenant, ignoring the
+// shared servers
+func (s *ServerStore) GetOwn(tenant, name string) (*Server, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	srv, ok := s.tenants[tenant][name]
+	if !ok {
+		return nil, false
+	}
+	c := *srv
+	return &c, true
+}
+
+// restoreTrust marks a server as trusted if it's identical to the trusted
+// server of the same name available to the tenant. The flag isn't persisted
+// with the releases, and s may be nil.
+func (s *ServerStore) restoreTrust(tenant string, srv *Server) {
+	if s == nil || srv == nil {
+		return
+	}
+	stored, ok := s.Get(tenant, srv.Name)
+	if !ok || !stored.trusted {
+		return
+	}
+	c := *srv
+	c.trusted = true
+	if c == *stored {
+		srv.trusted = true
+	}
+}
+
+// List returns copies of the servers available to the tenant, sorted by name
+func (s *ServerStore) List(tenant string) []*Server {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	byName := make(map[string]*Server)
+	for n, srv := range s.shared {
+		byName[n] = srv
+	}
+	for n, srv := range s.tenants[tenant] {
+		byName[n] = srv
+	}
+
+	servers := make([]*Server, 0, len(byName))
+	for _, srv := range byName {
+		c := *srv
+		servers = append(servers, &c)
+	}
+	sort.Slice(servers, func(i, j int) bool { return servers[i].Name < servers[j].Name })
+	return servers
+}
+
+// Add adds a server to the tenant, failing if the name is taken by one
+// of its servers or a shared server
+func (s *ServerStore) Add(tenant string, srv *Server) error {
+	return s.put(tenant, srv, false)
+}
+
+// Put adds or replaces a server of the tenant, which may shadow a shared server
+func (s *ServerStore) Put(tenant string, srv *Server) error {
+	return s.put(tenant, srv, true)
+}
+
+func (s *ServerStore) put(tenant string, srv *Server, replace bool) error {
+	if len(srv.Name) == 0 || len(srv.Host) == 0 {
+		return ErrInvalidServer
+	}
+	if err := srv.Validate(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !replace {
+		_, ok := s.tenants[tenant][srv.Name]
+		if _, shared := s.shared[srv.Name]; ok || shared {
+			return ErrServerExists
+		}
+	}
+	if _, ok := s.tenants[tenant]; !ok {
+		s.tenants[tenant] = make(map[string]*Server)
+	}
+
+	c := *srv
+	c.Save = false
+	s.tenants[tenant][srv.Name] = &c
+	return s.save()
+}
+
+// Delete removes a server of the tenant. Shared servers can't be deleted.
+func (s *ServerStore) Delete(tenant, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.tenants[tenant][name]; !ok {
+		return ErrServerNotFound
+	}
+	delete(s.tenants[tenant], name)
+	return s.save()
+}
+
+// save persists the servers, the caller must hold s.mu
+func (s *ServerStore) save() error {
+	if len(s.path) == 0 {
+		return nil
+	}
+
+	f := serverFile{
+		Shared:  make(map[string]*Server),
+		Tenants: make(map[string]map[string]*Server),
+	}
+	for name, srv := range s.shared {
+		f.Shared[name] = s.cipher.sealServer(srv)
+	}
+	for tenant, servers := range s.tenants {
+		f.Tenants[tenant] = make(map[string]*Server)
+		for name, srv := range servers {
+			f.Tenants[tenant][name] = s.cipher.sealServer(srv)
+		}
+	}
+
+	b, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
@@ -0,0 +1,125 @@
+// Package retention deletes messages older than a maximum age, except for
+// starred messages.
+package retention
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/jay-dee7/MailHog-Server/metadata"
+	"github.com/jay-dee7/MailHog-Server/webhooks"
+	"github.com/jay-dee7/storage"
+	"github.com/mailhog/data"
+)
+
+// pageSize is the number of messages listed at once while sweeping
+const pageSize = 250
+
+// Sweeper periodically deletes expired messages of the tenants it knows of.
+// Tenants are tracked as they receive messages, and tenants with metadata
+// are known from the start.
+type Sweeper struct {
+	// MaxAge is how long messages are kept, forever if zero
+	MaxAge time.Duration
+	// Interval is the delay between sweeps
+	Interval time.Duration
+
+	storage  storage.MultiTenantStorage
+	meta     *metadata.Store
+	webhooks *webhooks.Dispatcher
+	mu       sync.Mutex
+	tenants  map[string]bool
+}
+
+// NewSweeper creates a sweeper deleting messages older than maxAge, and
+// notifying the webhooks of the deletions
+func NewSweeper(storage storage.MultiTenantStorage, meta *metadata.Store, w *webhooks.Dispatcher, maxAge time.Duration) *Sweeper {
+	s := &Sweeper{
+		MaxAge:   maxAge,
+		Interval: time.Minute,
+		storage:  storage,
+		meta:     meta,
+		webhooks: w,
+		tenants:  make(map[string]bool),
+	}
+	for _, t := range meta.Tenants() {
+		s.tenants[t] = true
+	}
+	return s
+}
+
+// Track adds a tenant to the tenants which are swept
+func (s *Sweeper) Track(tenant string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tenants[tenant] = true
+}
+
+// Start runs the sweeps in the background, unless MaxAge is zero
+func (s *Sweeper) Start() {
+	if s.MaxAge <= 0 {
+		return
+	}
+	go func() {
+		for range time.Tick(s.Interval) {
+			s.Sweep()
+		}
+	}()
+}
+
+// Sweep deletes the expired messages of every tracked tenant
+func (s *Sweeper) Sweep() {
+	s.mu.Lock()
+	var tenants []string
+	for t := range s.tenants {
+		tenants = append(tenants, t)
+	}
+	s.mu.Unlock()
+
+	for _, t := range tenants {
+		n, err := s.sweep(t)
+		if err != nil {
+			log.Printf("[RETENTION] Error sweeping tenant %s: %s", t, err)
+		}
+		if n > 0 {
+			log.Printf("[RETENTION] Deleted %d expired messages of tenant %s", n, t)
+		}
+	}
+}
+
+func (s *Sweeper) sweep(tenant string) (int, error) {
+	cutoff := time.Now().Add(-s.MaxAge)
+	starred := s.meta.Find(tenant, func(m metadata.Meta) bool { return m.Starred })
+
+	var expired []data.Message
+	for offset := 0; ; offset += pageSize {
+		page, err := s.storage.List(offset, pageSize, tenant)
+		if err != nil {
+			return 0, err
+		}
+		for _, m := range *page {
+			if m.Created.Before(cutoff) && !starred[string(m.ID)] {
+				expired = append(expired, m)
+			}
+		}
+		if len(*page) < pageSize {
+			break
+		}
+	}
+
+	for i := range expired {
+		m := &expired[i]
+		id := string(m.ID)
+		if err := s.storage.DeleteOne(id, tenant); err != nil {
+			return i, err
+		}
+		if s.webhooks != nil {
+			s.webhooks.Notify(webhooks.Event{Type: webhooks.Deleted, Tenant: tenant, MessageID: id, Message: m})
+		}
+		if err := s.meta.Delete(tenant, id); err != nil {
+			return i + 1, err
+		}
+	}
+	return len(expired), nil
+}
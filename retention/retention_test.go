@@ -0,0 +1,94 @@
+package retention
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/jay-dee7/MailHog-Server/metadata"
+	"github.com/jay-dee7/MailHog-Server/webhooks"
+	"github.com/mailhog/data"
+)
+
+// fakeStorage keeps the messages of each tenant in memory
+type fakeStorage map[string]data.Messages
+
+func (s fakeStorage) Store(m *data.Message, tenant string) (string, error) {
+	s[tenant] = append(s[tenant], *m)
+	return string(m.ID), nil
+}
+func (s fakeStorage) List(start, limit int, tenant string) (*data.Messages, error) {
+	msgs := s[tenant]
+	if start > len(msgs) {
+		start = len(msgs)
+	}
+	if start+limit < len(msgs) {
+		msgs = msgs[:start+limit]
+	}
+	page := msgs[start:]
+	return &page, nil
+}
+func (s fakeStorage) Search(kind, query string, start, limit int, tenant string) (*data.Messages, int, error) {
+	return &data.Messages{}, 0, nil
+}
+func (s fakeStorage) Count(tenant string) int { return len(s[tenant]) }
+func (s fakeStorage) DeleteOne(id, tenant string) error {
+	msgs := data.Messages{}
+	for _, m := range s[tenant] {
+		if string(m.ID) != id {
+			msgs = append(msgs, m)
+		}
+	}
+	s[tenant] = msgs
+	return nil
+}
+func (s fakeStorage) DeleteAll(tenant string) error { delete(s, tenant); return nil }
+func (s fakeStorage) Load(id, tenant string) (*data.Message, error) {
+	return nil, nil
+}
+
+func TestSweep(t *testing.T) {
+	Convey("Sweep should delete expired messages except starred ones", t, func() {
+		storage := fakeStorage{}
+		old := time.Now().Add(-48 * time.Hour)
+		storage.Store(&data.Message{ID: "old", Created: old}, "a")
+		storage.Store(&data.Message{ID: "starred", Created: old}, "a")
+		storage.Store(&data.Message{ID: "new", Created: time.Now()}, "a")
+		storage.Store(&data.Message{ID: "untracked", Created: old}, "b")
+
+		meta, _ := metadata.NewStore("")
+		starred := true
+		meta.Update("a", "starred", metadata.Update{Starred: &starred})
+
+		deleted := make(chan string, 10)
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var e webhooks.Event
+			json.NewDecoder(r.Body).Decode(&e)
+			deleted <- e.Type + " " + e.MessageID
+		}))
+		defer srv.Close()
+		w, _ := webhooks.NewDispatcher("", nil)
+		w.Put("a", webhooks.Webhook{Name: "ci", URL: srv.URL})
+
+		s := NewSweeper(storage, meta, w, 24*time.Hour)
+		s.Sweep()
+
+		var ids []string
+		for _, m := range storage["a"] {
+			ids = append(ids, string(m.ID))
+		}
+		So(ids, ShouldResemble, []string{"starred", "new"})
+		So(storage["b"], ShouldHaveLength, 1)
+
+		select {
+		case e := <-deleted:
+			So(e, ShouldEqual, "deleted old")
+		case <-time.After(2 * time.Second):
+			So("no webhook received", ShouldBeEmpty)
+		}
+	})
+}
@@ -0,0 +1,455 @@
+// Package rules evaluates per-tenant rules against accepted messages to
+// tag, drop, reject, delay, forward or route them.
+package rules
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jay-dee7/MailHog-Server/mimetree"
+	"github.com/jay-dee7/MailHog-Server/release"
+	"github.com/mailhog/data"
+)
+
+// Action types
+const (
+	Tag     = "tag"
+	Drop    = "drop"
+	Reject  = "reject"
+	Delay   = "delay"
+	Forward = "forward"
+	Route   = "route"
+)
+
+// MaxDelay limits the delay action, since it holds the SMTP session open
+const MaxDelay = 5 * time.Minute
+
+// reloadInterval is how often the rules file is checked for changes
+const reloadInterval = time.Second
+
+// ErrRuleNotFound is returned for an unknown rule
+var ErrRuleNotFound = errors.New("rule not found")
+
+// ErrRouteNotAllowed is returned for a route action to a tenant which isn't
+// allowed by the operator
+var ErrRouteNotAllowed = errors.New("route action to this tenant isn't allowed")
+
+// Routes holds the tenants which the route actions of each tenant may
+// deliver messages to
+type Routes map[string]map[string]bool
+
+// ParseRoutes parses comma separated source:target tenant pairs
+func ParseRoutes(s string) (Routes, error) {
+	routes := make(Routes)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if len(pair) == 0 {
+			continue
+		}
+		p := strings.SplitN(pair, ":", 2)
+		if len(p) != 2 || len(p[0]) == 0 || len(p[1]) == 0 {
+			return nil, fmt.Errorf("invalid route %q, expected source:target", pair)
+		}
+		if _, ok := routes[p[0]]; !ok {
+			routes[p[0]] = make(map[string]bool)
+		}
+		routes[p[0]][p[1]] = true
+	}
+	return routes, nil
+}
+
+// Allowed returns true if the route actions of tenant may deliver to target
+func (r Routes) Allowed(tenant, target string) bool {
+	return r[tenant][target]
+}
+
+// Match holds the conditions of a rule. Every condition which is set must
+// match, text conditions are regular expressions.
+type Match struct {
+	// From matches the envelope sender
+	From string `json:"from,omitempty"`
+	// To matches any envelope recipient
+	To string `json:"to,omitempty"`
+	// Header names a header which must be present, and Value matches any
+	// of its values if set
+	Header string `json:"header,omitempty"`
+	Value  string `json:"value,omitempty"`
+	// Body matches the raw body of the message
+	Body string `json:"body,omitempty"`
+	// MinSize and MaxSize bound the size of the message in bytes
+	MinSize int `json:"minSize,omitempty"`
+	MaxSize int `json:"maxSize,omitempty"`
+
+	from, to, value, body *regexp.Regexp
+}
+
+// Action is applied to the messages matching a rule
+type Action struct {
+	Type string `json:"type"`
+	// Tags are added to the message by a tag action
+	Tags []string `json:"tags,omitempty"`
+	// Code and Message are the SMTP reply of a reject action
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+	// Delay postpones the reply to DATA for a delay action, e.g. 30s
+	Delay string `json:"delay,omitempty"`
+	// Server and Options describe the release of a forward action
+	Server  string          `json:"server,omitempty"`
+	Options release.Options `json:"options,omitempty"`
+	// Tenant receives the message instead for a route action, if the
+	// Routes of the engine allow it
+	Tenant string `json:"tenant,omitempty"`
+
+	delay time.Duration
+}
+
+// Rule applies actions to the messages matching its conditions
+type Rule struct {
+	Name string `json:"name"`
+	// Priority orders the rules of a tenant, lowest first, then by name
+	Priority int      `json:"priority"`
+	Match    Match    `json:"match"`
+	Actions  []Action `json:"actions"`
+	// Stop skips the remaining rules if this one matches
+	Stop bool `json:"stop,omitempty"`
+}
+
+// Compile validates a rule and compiles its regular expressions
+func (r *Rule) Compile() error {
+	if len(r.Name) == 0 {
+		return errors.New("rule requires a name")
+	}
+	if len(r.Actions) == 0 {
+		return errors.New("rule requires at least one action")
+	}
+
+	m := &r.Match
+	var err error
+	for _, c := range []struct {
+		expr string
+		re   **regexp.Regexp
+	}{{m.From, &m.from}, {m.To, &m.to}, {m.Value, &m.value}, {m.Body, &m.body}} {
+		*c.re = nil
+		if len(c.expr) == 0 {
+			continue
+		}
+		if *c.re, err = regexp.Compile(c.expr); err != nil {
+			return err
+		}
+	}
+
+	for i := range r.Actions {
+		if err := r.Actions[i].compile(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *Action) compile() error {
+	switch a.Type {
+	case Tag:
+		if len(a.Tags) == 0 {
+			return errors.New("tag action requires tags")
+		}
+	case Drop:
+	case Reject:
+		if a.Code < 400 || a.Code > 599 {
+			return errors.New("reject action requires a 4xx or 5xx code")
+		}
+		if strings.ContainsAny(a.Message, "\r\n") {
+			return errors.New("reject action message can't contain line breaks")
+		}
+	case Delay:
+		d, err := time.ParseDuration(a.Delay)
+		if err != nil || d <= 0 || d > MaxDelay {
+			return fmt.Errorf("delay action requires a delay of up to %s", MaxDelay)
+		}
+		a.delay = d
+	case Forward:
+		if len(a.Server) == 0 {
+			return errors.New("forward action requires a server")
+		}
+		if err := a.Options.Validate(); err != nil {
+			return err
+		}
+	case Route:
+		if len(a.Tenant) == 0 {
+			return errors.New("route action requires a tenant")
+		}
+	default:
+		return errors.New("invalid action type: " + a.Type)
+	}
+	return nil
+}
+
+// Matches returns true if the message matches every condition of the rule
+func (r *Rule) Matches(msg *data.Message) bool {
+	m := &r.Match
+	raw := msg.Raw
+	if raw == nil {
+		raw = &data.SMTPMessage{}
+	}
+
+	if m.from != nil && !m.from.MatchString(raw.From) {
+		return false
+	}
+	if m.to != nil && !anyMatch(m.to, raw.To) {
+		return false
+	}
+	if len(m.Header) > 0 {
+		values := mimetree.Header(msg, m.Header)
+		if len(values) == 0 || (m.value != nil && !anyMatch(m.value, values)) {
+			return false
+		}
+	}
+	if m.body != nil && (msg.Content == nil || !m.body.MatchString(msg.Content.Body)) {
+		return false
+	}
+	if size := len(raw.Data); (m.MinSize > 0 && size < m.MinSize) || (m.MaxSize > 0 && size > m.MaxSize) {
+		return false
+	}
+	return true
+}
+
+func anyMatch(re *regexp.Regexp, values []string) bool {
+	for _, v := range values {
+		if re.MatchString(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// Result combines the actions of the rules matching a message
+type Result struct {
+	// Rules are the names of the matching rules
+	Rules []string
+	Tags  []string
+	Drop  bool
+	// Reject is the first reject action, if any
+	Reject *Action
+	Delay  time.Duration
+	// Forwards are the forward actions
+	Forwards []Action
+	// Tenant is set if the message is routed to another tenant
+	Tenant string
+}
+
+// Engine holds the rules of each tenant. Changes made through the engine
+// apply immediately, and changes made to its file are picked up while
+// running.
+type Engine struct {
+	// Routes restricts route actions, which are refused if it's empty
+	Routes Routes
+
+	mu        sync.RWMutex
+	path      string
+	rules     map[string]map[string]*Rule
+	modTime   time.Time
+	lastCheck time.Time
+}
+
+// NewEngine creates an engine, loading the rules saved to path. An empty
+// path keeps the rules in memory only.
+func NewEngine(path string) (*Engine, error) {
+	e := &Engine{
+		path:  path,
+		rules: make(map[string]map[string]*Rule),
+	}
+	if err := e.load(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// load reads the rules file, the caller must hold e.mu or own e
+func (e *Engine) load() error {
+	if len(e.path) == 0 {
+		return nil
+	}
+
+	fi, err := os.Stat(e.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	b, err := ioutil.ReadFile(e.path)
+	if err != nil {
+		return err
+	}
+
+	rules := make(map[string]map[string]*Rule)
+	if err := json.Unmarshal(b, &rules); err != nil {
+		return err
+	}
+	for _, tenantRules := range rules {
+		for name, r := range tenantRules {
+			r.Name = name
+			if err := r.Compile(); err != nil {
+				return fmt.Errorf("rule %s: %s", name, err)
+			}
+		}
+	}
+
+	e.rules = rules
+	e.modTime = fi.ModTime()
+	return nil
+}
+
+// reload loads the rules file again if it changed since it was last read.
+// A file which fails to load is logged and the current rules are kept.
+func (e *Engine) reload() {
+	if len(e.path) == 0 {
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if time.Since(e.lastCheck) < reloadInterval {
+		return
+	}
+	e.lastCheck = time.Now()
+
+	fi, err := os.Stat(e.path)
+	if err != nil || fi.ModTime().Equal(e.modTime) {
+		return
+	}
+	if err := e.load(); err != nil {
+		log.Printf("[RULES] Error reloading %s: %s", e.path, err)
+		return
+	}
+	log.Printf("[RULES] Reloaded %s", e.path)
+}
+
+// List returns the rules of the tenant in evaluation order
+func (e *Engine) List(tenant string) []Rule {
+	e.reload()
+
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	rules := []Rule{}
+	for _, r := range e.rules[tenant] {
+		rules = append(rules, *r)
+	}
+	sort.Slice(rules, func(i, j int) bool {
+		if rules[i].Priority != rules[j].Priority {
+			return rules[i].Priority < rules[j].Priority
+		}
+		return rules[i].Name < rules[j].Name
+	})
+	return rules
+}
+
+// Put validates and adds or replaces a rule of the tenant
+func (e *Engine) Put(tenant string, r Rule) error {
+	if err := r.Compile(); err != nil {
+		return err
+	}
+	for _, a := range r.Actions {
+		if a.Type == Route && !e.Routes.Allowed(tenant, a.Tenant) {
+			return ErrRouteNotAllowed
+		}
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if _, ok := e.rules[tenant]; !ok {
+		e.rules[tenant] = make(map[string]*Rule)
+	}
+	e.rules[tenant][r.Name] = &r
+	return e.save()
+}
+
+// Delete removes a rule of the tenant
+func (e *Engine) Delete(tenant, name string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if _, ok := e.rules[tenant][name]; !ok {
+		return ErrRuleNotFound
+	}
+	delete(e.rules[tenant], name)
+	return e.save()
+}
+
+// Evaluate applies the rules of the tenant to a message
+func (e *Engine) Evaluate(tenant string, msg *data.Message) Result {
+	var res Result
+	for _, r := range e.List(tenant) {
+		if !r.Matches(msg) {
+			continue
+		}
+
+		res.Rules = append(res.Rules, r.Name)
+		for i := range r.Actions {
+			a := r.Actions[i]
+			switch a.Type {
+			case Tag:
+				res.Tags = append(res.Tags, a.Tags...)
+			case Drop:
+				res.Drop = true
+			case Reject:
+				if res.Reject == nil {
+					res.Reject = &a
+				}
+			case Delay:
+				res.Delay += a.delay
+			case Forward:
+				res.Forwards = append(res.Forwards, a)
+			case Route:
+				// rules from the file aren't checked when they're loaded
+				if e.Routes.Allowed(tenant, a.Tenant) {
+					res.Tenant = a.Tenant
+				}
+			}
+		}
+		if r.Stop {
+			break
+		}
+	}
+	if res.Delay > MaxDelay {
+		res.Delay = MaxDelay
+	}
+	return res
+}
+
+// save persists the rules, the caller must hold e.mu
+func (e *Engine) save() error {
+	if len(e.path) == 0 {
+		return nil
+	}
+
+	b, err := json.MarshalIndent(e.rules, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := e.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, e.path); err != nil {
+		return err
+	}
+
+	// the engine's own writes don't need reloading
+	if fi, err := os.Stat(e.path); err == nil {
+		e.modTime = fi.ModTime()
+	}
+	return nil
+}
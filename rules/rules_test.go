@@ -0,0 +1,109 @@
+package rules
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/mailhog/data"
+)
+
+func message(from, to, subject, body string) *data.Message {
+	return &data.Message{
+		Raw: &data.SMTPMessage{From: from, To: []string{to}, Data: "Subject: " + subject + "\r\n\r\n" + body},
+		Content: &data.Content{
+			Headers: map[string][]string{"Subject": {subject}},
+			Body:    body,
+		},
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	Convey("Matching rules should be combined in priority order", t, func() {
+		e, _ := NewEngine("")
+		e.Routes = Routes{"a": {"billing": true}}
+		So(e.Put("a", Rule{Name: "tag", Priority: 1, Match: Match{To: `@qa\.example$`}, Actions: []Action{{Type: Tag, Tags: []string{"qa"}}}}), ShouldBeNil)
+		So(e.Put("a", Rule{Name: "route", Priority: 2, Match: Match{Header: "subject", Value: "^Invoice"}, Actions: []Action{{Type: Route, Tenant: "billing"}}, Stop: true}), ShouldBeNil)
+		So(e.Put("a", Rule{Name: "reject", Priority: 3, Match: Match{Body: "OINK"}, Actions: []Action{{Type: Reject, Code: 554, Message: "No pigs"}}}), ShouldBeNil)
+
+		res := e.Evaluate("a", message("a@mailhog.example", "b@qa.example", "Invoice 1", "OINK"))
+		So(res.Rules, ShouldResemble, []string{"tag", "route"})
+		So(res.Tags, ShouldResemble, []string{"qa"})
+		So(res.Tenant, ShouldEqual, "billing")
+		So(res.Reject, ShouldBeNil)
+
+		res = e.Evaluate("a", message("a@mailhog.example", "b@mailhog.example", "Hello", "OINK"))
+		So(res.Reject.Code, ShouldEqual, 554)
+		So(e.Evaluate("b", message("a@mailhog.example", "b@qa.example", "Invoice 1", "OINK")).Rules, ShouldBeEmpty)
+	})
+
+	Convey("Route actions should be restricted to the allowed tenants", t, func() {
+		routes, err := ParseRoutes("a:billing, b:billing")
+		So(err, ShouldBeNil)
+		So(routes.Allowed("a", "billing"), ShouldBeTrue)
+		So(routes.Allowed("billing", "a"), ShouldBeFalse)
+		_, err = ParseRoutes("a")
+		So(err, ShouldNotBeNil)
+
+		e, _ := NewEngine("")
+		e.Routes = routes
+		So(e.Put("a", Rule{Name: "route", Actions: []Action{{Type: Route, Tenant: "c"}}}), ShouldEqual, ErrRouteNotAllowed)
+		e.Routes = nil
+		So(e.Put("a", Rule{Name: "route", Actions: []Action{{Type: Route, Tenant: "billing"}}}), ShouldEqual, ErrRouteNotAllowed)
+	})
+
+	Convey("Size conditions should bound the raw message", t, func() {
+		r := Rule{Name: "big", Match: Match{MinSize: 100}, Actions: []Action{{Type: Drop}}}
+		So(r.Compile(), ShouldBeNil)
+		So(r.Matches(message("a@mailhog.example", "b@mailhog.example", "Hello", "small")), ShouldBeFalse)
+		So(r.Matches(message("a@mailhog.example", "b@mailhog.example", "Hello", string(make([]byte, 100)))), ShouldBeTrue)
+	})
+
+	Convey("Invalid actions should be rejected", t, func() {
+		e, _ := NewEngine("")
+		So(e.Put("a", Rule{Name: "r", Actions: []Action{{Type: Reject, Code: 250}}}), ShouldNotBeNil)
+		So(e.Put("a", Rule{Name: "r", Actions: []Action{{Type: Reject, Code: 554, Message: "No\r\n250 OK"}}}), ShouldNotBeNil)
+		So(e.Put("a", Rule{Name: "r", Actions: []Action{{Type: Delay, Delay: "1h"}}}), ShouldNotBeNil)
+		So(e.Put("a", Rule{Name: "r", Actions: []Action{{Type: "OINK"}}}), ShouldNotBeNil)
+		So(e.Put("a", Rule{Name: "r"}), ShouldNotBeNil)
+	})
+}
+
+func TestReload(t *testing.T) {
+	Convey("Changes to the rules file should be picked up", t, func() {
+		dir, _ := ioutil.TempDir("", "rules")
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "rules.json")
+
+		e, err := NewEngine(path)
+		So(err, ShouldBeNil)
+		So(e.Put("a", Rule{Name: "drop", Actions: []Action{{Type: Drop}}}), ShouldBeNil)
+		So(e.List("a"), ShouldHaveLength, 1)
+
+		ioutil.WriteFile(path, []byte(`{"a":{"one":{"actions":[{"type":"drop"}]},"two":{"actions":[{"type":"drop"}]}}}`), 0600)
+		future := time.Now().Add(time.Minute)
+		os.Chtimes(path, future, future)
+		e.lastCheck = time.Time{}
+		So(e.List("a"), ShouldHaveLength, 2)
+
+		ioutil.WriteFile(path, []byte(`OINK`), 0600)
+		future = future.Add(time.Minute)
+		os.Chtimes(path, future, future)
+		e.lastCheck = time.Time{}
+		So(e.List("a"), ShouldHaveLength, 2)
+	})
+}
+
+func TestHeaderCase(t *testing.T) {
+	Convey("Header conditions should ignore the case of stored headers", t, func() {
+		r := Rule{Name: "id", Match: Match{Header: "message-id", Value: "mailhog"}, Actions: []Action{{Type: Drop}}}
+		So(r.Compile(), ShouldBeNil)
+		m := message("a@mailhog.example", "b@mailhog.example", "Hello", "")
+		m.Content.Headers["Message-ID"] = []string{"<1@mailhog.example>"}
+		So(r.Matches(m), ShouldBeTrue)
+	})
+}
@@ -0,0 +1,257 @@
+// Package scenario applies deterministic, scripted SMTP replies to the
+// commands of a tenant's sessions, to test how clients retry and bounce.
+package scenario
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Stages a step applies to
+const (
+	Mail = "mail"
+	Rcpt = "rcpt"
+	Data = "data"
+)
+
+// Scopes in which the matching commands of a step are counted
+const (
+	// Global counts every matching command since the scenario was loaded
+	Global = ""
+	// Session counts the matching commands of each session
+	Session = "session"
+	// Sender counts the matching commands of each envelope sender
+	Sender = "sender"
+	// Recipient counts the matching commands of each recipient
+	Recipient = "recipient"
+)
+
+// ErrScenarioNotFound is returned for an unknown scenario
+var ErrScenarioNotFound = errors.New("scenario not found")
+
+// Step replies to matching commands with a fixed code
+type Step struct {
+	// Stage is the command the step applies to: mail, rcpt or data
+	Stage string `json:"stage"`
+	// Match is a regular expression matched against the sender for mail,
+	// the recipient for rcpt and any recipient for data, empty matches all
+	Match string `json:"match,omitempty"`
+	// Nth applies the step to the nth matching command of its scope only,
+	// starting at 1, or to every matching command if 0
+	Nth   int    `json:"nth,omitempty"`
+	Scope string `json:"scope,omitempty"`
+	// Code and Message are the reply, e.g. 550 and "5.1.1 User unknown"
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+	// Disconnect closes the connection after the reply
+	Disconnect bool `json:"disconnect,omitempty"`
+
+	match  *regexp.Regexp
+	counts map[string]int
+}
+
+// Scenario is a named script of steps, the first step applying to a
+// command replies to it
+type Scenario struct {
+	Name  string `json:"name"`
+	Steps []Step `json:"steps"`
+}
+
+// compile validates the scenario and compiles its regular expressions
+func (s *Scenario) compile() error {
+	if len(s.Name) == 0 {
+		return errors.New("scenario requires a name")
+	}
+	if len(s.Steps) == 0 {
+		return errors.New("scenario requires at least one step")
+	}
+
+	for i := range s.Steps {
+		st := &s.Steps[i]
+		switch st.Stage {
+		case Mail, Rcpt, Data:
+		default:
+			return fmt.Errorf("step %d: invalid stage %q", i+1, st.Stage)
+		}
+		switch st.Scope {
+		case Global, Session, Sender, Recipient:
+		default:
+			return fmt.Errorf("step %d: invalid scope %q", i+1, st.Scope)
+		}
+		if st.Code < 400 || st.Code > 599 {
+			return fmt.Errorf("step %d: requires a 4xx or 5xx code", i+1)
+		}
+		if strings.ContainsAny(st.Message, "\r\n") {
+			return fmt.Errorf("step %d: message can't contain line breaks", i+1)
+		}
+		if st.Nth < 0 {
+			return fmt.Errorf("step %d: nth can't be negative", i+1)
+		}
+
+		st.match = nil
+		if len(st.Match) > 0 {
+			re, err := regexp.Compile(st.Match)
+			if err != nil {
+				return fmt.Errorf("step %d: %s", i+1, err)
+			}
+			st.match = re
+		}
+		st.counts = make(map[string]int)
+	}
+	return nil
+}
+
+// Command is an SMTP command scenarios are applied to
+type Command struct {
+	Stage string
+	From  string
+	// To is the recipient for rcpt, and every recipient for data
+	To []string
+	// Counts holds the counters of the steps scoped to the session
+	Counts map[string]int
+}
+
+// Reply is the scripted reply to a command
+type Reply struct {
+	Scenario   string
+	Code       int
+	Message    string
+	Disconnect bool
+}
+
+// matches returns true if the step applies to the command
+func (st *Step) matches(c Command) bool {
+	if st.Stage != c.Stage {
+		return false
+	}
+	if st.match == nil {
+		return true
+	}
+	if c.Stage == Mail {
+		return st.match.MatchString(c.From)
+	}
+	for _, to := range c.To {
+		if st.match.MatchString(to) {
+			return true
+		}
+	}
+	return false
+}
+
+// count increments and returns the counter of the scope of the command
+func (st *Step) count(scenario string, step int, c Command) int {
+	counts, key := st.counts, ""
+	switch st.Scope {
+	case Session:
+		counts, key = c.Counts, fmt.Sprintf("%s/%d", scenario, step)
+	case Sender:
+		key = strings.ToLower(c.From)
+	case Recipient:
+		key = strings.ToLower(strings.Join(c.To, ","))
+	}
+	counts[key]++
+	return counts[key]
+}
+
+// Store holds the scenarios of each tenant in memory, along with the
+// counters of their steps
+type Store struct {
+	mu        sync.Mutex
+	scenarios map[string]map[string]*Scenario
+}
+
+// NewStore creates an empty scenario store
+func NewStore() *Store {
+	return &Store{scenarios: make(map[string]map[string]*Scenario)}
+}
+
+// List returns the scenarios of the tenant, sorted by name
+func (s *Store) List(tenant string) []Scenario {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	scenarios := []Scenario{}
+	for _, sc := range s.scenarios[tenant] {
+		scenarios = append(scenarios, *sc)
+	}
+	sort.Slice(scenarios, func(i, j int) bool { return scenarios[i].Name < scenarios[j].Name })
+	return scenarios
+}
+
+// Put validates and adds or replaces a scenario of the tenant, starting its
+// counters from zero
+func (s *Store) Put(tenant string, sc Scenario) error {
+	sc.Steps = append([]Step(nil), sc.Steps...)
+	if err := sc.compile(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.scenarios[tenant]; !ok {
+		s.scenarios[tenant] = make(map[string]*Scenario)
+	}
+	s.scenarios[tenant][sc.Name] = &sc
+	return nil
+}
+
+// Reset starts the counters of a scenario of the tenant from zero
+func (s *Store) Reset(tenant, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sc, ok := s.scenarios[tenant][name]
+	if !ok {
+		return ErrScenarioNotFound
+	}
+	for i := range sc.Steps {
+		sc.Steps[i].counts = make(map[string]int)
+	}
+	return nil
+}
+
+// Delete removes a scenario of the tenant
+func (s *Store) Delete(tenant, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.scenarios[tenant][name]; !ok {
+		return ErrScenarioNotFound
+	}
+	delete(s.scenarios[tenant], name)
+	return nil
+}
+
+// Apply counts the command for every matching step of the scenarios of the
+// tenant, and returns the reply of the first step applying to it, if any
+func (s *Store) Apply(tenant string, c Command) *Reply {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	names := make([]string, 0, len(s.scenarios[tenant]))
+	for name := range s.scenarios[tenant] {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var reply *Reply
+	for _, name := range names {
+		sc := s.scenarios[tenant][name]
+		for i := range sc.Steps {
+			st := &sc.Steps[i]
+			if !st.matches(c) {
+				continue
+			}
+			n := st.count(name, i, c)
+			if reply == nil && (st.Nth == 0 || st.Nth == n) {
+				reply = &Reply{Scenario: name, Code: st.Code, Message: st.Message, Disconnect: st.Disconnect}
+			}
+		}
+	}
+	return reply
+}
@@ -0,0 +1,55 @@
+package scenario
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestApply(t *testing.T) {
+	Convey("Steps should reply to the nth matching command", t, func() {
+		s := NewStore()
+		So(s.Put("a", Scenario{Name: "third-rcpt", Steps: []Step{{Stage: Rcpt, Nth: 3, Code: 550, Message: "5.1.1 User unknown"}}}), ShouldBeNil)
+
+		counts := make(map[string]int)
+		rcpt := Command{Stage: Rcpt, From: "a@mailhog.example", To: []string{"b@mailhog.example"}, Counts: counts}
+		So(s.Apply("a", rcpt), ShouldBeNil)
+		So(s.Apply("a", rcpt), ShouldBeNil)
+		So(s.Apply("a", rcpt), ShouldResemble, &Reply{Scenario: "third-rcpt", Code: 550, Message: "5.1.1 User unknown"})
+		So(s.Apply("a", rcpt), ShouldBeNil)
+		So(s.Apply("b", rcpt), ShouldBeNil)
+
+		So(s.Reset("a", "third-rcpt"), ShouldBeNil)
+		s.Apply("a", rcpt)
+		s.Apply("a", rcpt)
+		So(s.Apply("a", rcpt), ShouldNotBeNil)
+	})
+
+	Convey("Steps should match recipients and count per scope", t, func() {
+		s := NewStore()
+		So(s.Put("a", Scenario{Name: "s", Steps: []Step{
+			{Stage: Data, Match: `@bounce\.example$`, Code: 421, Disconnect: true},
+			{Stage: Rcpt, Nth: 1, Scope: Recipient, Code: 451},
+		}}), ShouldBeNil)
+
+		data := Command{Stage: Data, To: []string{"x@mailhog.example", "y@bounce.example"}}
+		So(s.Apply("a", data).Disconnect, ShouldBeTrue)
+		data.To = data.To[:1]
+		So(s.Apply("a", data), ShouldBeNil)
+
+		first := Command{Stage: Rcpt, To: []string{"x@mailhog.example"}}
+		second := Command{Stage: Rcpt, To: []string{"y@mailhog.example"}}
+		So(s.Apply("a", first).Code, ShouldEqual, 451)
+		So(s.Apply("a", second).Code, ShouldEqual, 451)
+		So(s.Apply("a", first), ShouldBeNil)
+	})
+
+	Convey("Invalid steps should be rejected", t, func() {
+		s := NewStore()
+		So(s.Put("a", Scenario{Name: "s", Steps: []Step{{Stage: "helo", Code: 550}}}), ShouldNotBeNil)
+		So(s.Put("a", Scenario{Name: "s", Steps: []Step{{Stage: Rcpt, Code: 250}}}), ShouldNotBeNil)
+		So(s.Put("a", Scenario{Name: "s", Steps: []Step{{Stage: Rcpt, Code: 550, Match: "("}}}), ShouldNotBeNil)
+		So(s.Put("a", Scenario{Name: "s", Steps: []Step{{Stage: Rcpt, Code: 550, Message: "x\r\n250 OK"}}}), ShouldNotBeNil)
+		So(s.Delete("a", "s"), ShouldEqual, ErrScenarioNotFound)
+	})
+}
@@ -3,10 +3,26 @@ package smtp
 // http://www.rfc-editor.org/rfc/rfc5321.txt
 
 import (
+	"encoding/base64"
+	"errors"
+	"fmt"
 	"io"
+	"log"
+	"math"
+	"net"
 	"strings"
+	"time"
+	"unicode"
 
 	"github.com/ian-kent/linkio"
+	"github.com/jay-dee7/MailHog-Server/config"
+	"github.com/jay-dee7/MailHog-Server/metadata"
+	"github.com/jay-dee7/MailHog-Server/msgauth"
+	"github.com/jay-dee7/MailHog-Server/release"
+	"github.com/jay-dee7/MailHog-Server/rules"
+	"github.com/jay-dee7/MailHog-Server/scenario"
+	"github.com/jay-dee7/MailHog-Server/transcript"
+	"github.com/jay-dee7/MailHog-Server/webhooks"
 	"github.com/jay-dee7/smtp"
 	"github.com/jay-dee7/storage"
 	"github.com/mailhog/MailHog-Server/monkey"
@@ -17,6 +33,7 @@ import (
 type Session struct {
 	conn          io.ReadWriteCloser
 	proto         *smtp.Protocol
+	config        *config.Config
 	storage       storage.MultiTenantStorage
 	messageChan   chan *data.Message
 	remoteAddress string
@@ -28,14 +45,36 @@ type Session struct {
 	writer io.Writer
 	monkey monkey.ChaosMonkey
 	tenant string
+
+	// ehlo and authUser describe the session in the trace headers
+	ehlo     bool
+	authUser string
+
+	// transcript records the conversation, with the size of message data
+	// counted in dataSize
+	transcript *transcript.Transcript
+	dataSize   int
+
+	// scenarioCounts counts the commands for steps scoped to the session,
+	// and disconnect closes the connection after a scripted reply
+	scenarioCounts map[string]int
+	disconnect     bool
+
+	// reply replaces the next reply of the protocol, so that handlers can
+	// respond with codes the protocol doesn't support
+	reply *smtp.Reply
 }
 
 // Accept starts a new SMTP session using io.ReadWriteCloser
-func Accept(remoteAddress string, conn io.ReadWriteCloser, storage storage.MultiTenantStorage, messageChan chan *data.Message, hostname string, monkey monkey.ChaosMonkey, tenant string) {
+func Accept(remoteAddress string, conn io.ReadWriteCloser, cfg *config.Config, tenant string) {
 	defer conn.Close()
 
+	monkey := cfg.Monkey
+	if cfg.Chaos != nil {
+		monkey = cfg.Chaos.Monkey(tenant)
+	}
 	proto := smtp.NewProtocol()
-	proto.Hostname = hostname
+	proto.Hostname = cfg.Hostname
 	var link *linkio.Link
 	reader := io.Reader(conn)
 	writer := io.Writer(conn)
@@ -48,18 +87,35 @@ func Accept(remoteAddress string, conn io.ReadWriteCloser, storage storage.Multi
 		}
 	}
 
-	session := &Session{conn, proto, storage, messageChan, remoteAddress, false, "", link, reader, writer, monkey, tenant}
+	session := &Session{
+		conn:          conn,
+		proto:         proto,
+		config:        cfg,
+		storage:       cfg.Storage,
+		messageChan:   cfg.MessageChan,
+		remoteAddress: remoteAddress,
+		link:          link,
+		reader:        reader,
+		writer:        writer,
+		monkey:        monkey,
+		tenant:        tenant,
+	}
 	proto.LogHandler = session.logf
 	proto.MessageReceivedHandler = session.acceptMessage
 	proto.ValidateSenderHandler = session.validateSender
 	proto.ValidateRecipientHandler = session.validateRecipient
 	proto.ValidateAuthenticationHandler = session.validateAuthentication
 	proto.GetAuthenticationMechanismsHandler = func() []string { return []string{"PLAIN"} }
+	proto.SMTPVerbFilter = session.verbFilter
+	if cfg.Transcripts != nil {
+		session.transcript = cfg.Transcripts.Start(tenant, remoteAddress)
+		defer session.transcript.End()
+	}
 
 	session.logf("Starting session")
 	session.Write(proto.Start())
 	for session.Read() == true {
-		if monkey != nil && monkey.Disconnect != nil && monkey.Disconnect() {
+		if monkey != nil && monkey.Disconnect() {
 			session.conn.Close()
 			break
 		}
@@ -67,6 +123,16 @@ func Accept(remoteAddress string, conn io.ReadWriteCloser, storage storage.Multi
 	session.logf("Session ended")
 }
 
+func (c *Session) verbFilter(verb string, args ...string) *smtp.Reply {
+	switch verb {
+	case "HELO":
+		c.ehlo = false
+	case "EHLO":
+		c.ehlo = true
+	}
+	return nil
+}
+
 func (c *Session) validateAuthentication(mechanism string, args ...string) (errorReply *smtp.Reply, ok bool) {
 	if c.monkey != nil {
 		ok := c.monkey.ValidAUTH(mechanism, args...)
@@ -75,9 +141,62 @@ func (c *Session) validateAuthentication(mechanism string, args ...string) (erro
 			return smtp.ReplyUnrecognisedCommand(), false
 		}
 	}
+	c.authUser = authUser(mechanism, args...)
 	return nil, true
 }
 
+// authUser returns the user name of the authentication arguments
+func authUser(mechanism string, args ...string) string {
+	if len(args) == 0 {
+		return ""
+	}
+	switch mechanism {
+	case "LOGIN":
+		b, _ := base64.StdEncoding.DecodeString(args[0])
+		return printable(string(b))
+	case "CRAM-MD5":
+		b, _ := base64.StdEncoding.DecodeString(args[0])
+		return printable(strings.SplitN(string(b), " ", 2)[0])
+	}
+	return printable(args[0])
+}
+
+// printable removes line breaks and other control characters, which could
+// inject headers when a client supplied value is added to the trace headers
+func printable(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// removeHeader removes every occurrence of a header, including its
+// continuation lines, from the header of a raw message
+func removeHeader(raw, name string) string {
+	end := strings.Index(raw, "\r\n\r\n")
+	if end < 0 {
+		end = len(raw)
+	}
+
+	var out strings.Builder
+	skip := false
+	for _, line := range strings.SplitAfter(raw[:end], "\r\n") {
+		if strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t") {
+			if !skip {
+				out.WriteString(line)
+			}
+			continue
+		}
+		skip = strings.EqualFold(strings.TrimSpace(strings.SplitN(line, ":", 2)[0]), name)
+		if !skip {
+			out.WriteString(line)
+		}
+	}
+	return out.String() + raw[end:]
+}
+
 func (c *Session) validateRecipient(to string) bool {
 	if c.monkey != nil {
 		ok := c.monkey.ValidRCPT(to)
@@ -85,7 +204,10 @@ func (c *Session) validateRecipient(to string) bool {
 			return false
 		}
 	}
-	return true
+	if c.scenario(scenario.Command{Stage: scenario.Rcpt, To: []string{to}}) {
+		return false
+	}
+	return !c.greylisted(to)
 }
 
 func (c *Session) validateSender(from string) bool {
@@ -95,19 +217,200 @@ func (c *Session) validateSender(from string) bool {
 			return false
 		}
 	}
+	return !c.scenario(scenario.Command{Stage: scenario.Mail, From: from})
+}
+
+// scenario applies the scenarios of the tenant to a command, and returns
+// true if a step replaced its reply
+func (c *Session) scenario(cmd scenario.Command) bool {
+	if c.config == nil || c.config.Scenarios == nil {
+		return false
+	}
+	if c.scenarioCounts == nil {
+		c.scenarioCounts = make(map[string]int)
+	}
+	if cmd.Stage == scenario.Rcpt {
+		cmd.From = c.proto.Message.From
+	}
+	cmd.Counts = c.scenarioCounts
+
+	r := c.config.Scenarios.Apply(c.tenant, cmd)
+	if r == nil {
+		return false
+	}
+	msg := r.Message
+	if len(msg) == 0 {
+		msg = "Reply from scenario " + r.Scenario
+	}
+	c.reply = smtp.ReplyError(errors.New(msg))
+	c.reply.Status = r.Code
+	c.disconnect = r.Disconnect
+	return true
+}
+
+// greylisted returns true and replies with a temporary failure if the
+// triplet of the client IP, sender and recipient hasn't waited long enough
+func (c *Session) greylisted(to string) bool {
+	if c.config == nil || c.config.Greylist == nil {
+		return false
+	}
+	ok, wait := c.config.Greylist.Check(c.tenant, c.remoteHost(), c.proto.Message.From, to)
+	if ok {
+		return false
+	}
+	c.reply = smtp.ReplyError(fmt.Errorf("4.7.1 Greylisted, please try again in %d seconds", int(math.Ceil(wait.Seconds()))))
+	c.reply.Status = 451
 	return true
 }
 
 func (c *Session) acceptMessage(msg *data.SMTPMessage) (string, error) {
+	if c.scenario(scenario.Command{Stage: scenario.Data, From: msg.From, To: msg.To}) {
+		return "", errors.New("Rejected by scenario")
+	}
+
 	m := msg.Parse(c.proto.Hostname)
+	auth := c.verify(m)
+	session := c.trace(m)
 
-	id, err := c.storage.Store(m, c.tenant)
+	tenant := c.tenant
+	var res rules.Result
+	if c.config.Rules != nil {
+		res = c.config.Rules.Evaluate(tenant, m)
+	}
+	if res.Delay > 0 {
+		time.Sleep(res.Delay)
+	}
+	if res.Reject != nil {
+		err := errors.New(res.Reject.Message)
+		if len(res.Reject.Message) == 0 {
+			err = errors.New("Rejected by rule")
+		}
+		c.reply = smtp.ReplyError(err)
+		c.reply.Status = res.Reject.Code
+		return "", err
+	}
+	if res.Drop {
+		// the client is told the message was queued, but it's discarded
+		return string(m.ID), nil
+	}
+	if len(res.Tenant) > 0 {
+		tenant = res.Tenant
+	}
+
+	id, err := c.storage.Store(m, tenant)
 	if err != nil {
 		c.logf("mongo message store error: %s", err)
 		return "", err
 	}
+
+	if c.config.Retention != nil {
+		c.config.Retention.Track(tenant)
+	}
+	if c.transcript != nil {
+		c.transcript.Stored(id)
+	}
+	if c.config.Metadata != nil {
+		err := c.config.Metadata.Accept(tenant, id, metadata.Accepted{Session: session, Auth: auth, Tags: res.Tags})
+		if err != nil {
+			log.Printf("[SMTP] Error saving metadata of message %s: %s", id, err)
+		}
+	}
+	for _, f := range res.Forwards {
+		c.forward(tenant, id, m, f)
+	}
+	if c.config.Webhooks != nil {
+		c.config.Webhooks.Notify(webhooks.Event{Type: webhooks.Stored, Tenant: tenant, MessageID: id, Message: m})
+	}
+	if c.config.AutoReleases != nil {
+		c.config.AutoReleases.Apply(tenant, id, m)
+	}
 	return id, nil
+}
+
+// remoteHost returns the IP address of the client
+func (c *Session) remoteHost() string {
+	host, _, err := net.SplitHostPort(c.remoteAddress)
+	if err != nil {
+		return c.remoteAddress
+	}
+	return host
+}
+
+// verify checks the DKIM signatures, SPF and DMARC of a message, and adds
+// an Authentication-Results header with the results
+func (c *Session) verify(m *data.Message) *msgauth.Results {
+	if c.config.Authentication == nil || m.Raw == nil {
+		return nil
+	}
+
+	auth := c.config.Authentication.Verify([]byte(m.Raw.Data), net.ParseIP(c.remoteHost()), m.Raw.Helo, m.Raw.From)
 
+	header := auth.Header(c.config.Hostname)
+	m.Content.Headers["Authentication-Results"] = append([]string{header}, m.Content.Headers["Authentication-Results"]...)
+	m.Raw.Data = "Authentication-Results: " + header + "\r\n" + m.Raw.Data
+	return auth
+}
+
+// trace adds the Received and Return-Path headers to a message, and returns
+// the record of the session
+func (c *Session) trace(m *data.Message) *metadata.Session {
+	session := &metadata.Session{
+		RemoteAddr: c.remoteAddress,
+		Helo:       m.Raw.Helo,
+		Protocol:   "SMTP",
+		TLS:        c.isTLS || c.proto.TLSUpgraded,
+		AuthUser:   c.authUser,
+		Tenant:     c.tenant,
+		From:       m.Raw.From,
+		To:         m.Raw.To,
+		Received:   m.Created,
+	}
+	if c.ehlo {
+		session.Protocol = "ESMTP"
+		if session.TLS {
+			session.Protocol += "S"
+		}
+		if len(c.authUser) > 0 {
+			session.Protocol += "A"
+		}
+	}
+
+	received := "from " + printable(session.Helo) + " ([" + c.remoteHost() + "])"
+	if len(session.AuthUser) > 0 {
+		received += "\r\n\t(authenticated user " + session.AuthUser + ")"
+	}
+	received += "\r\n\tby " + c.config.Hostname + " (MailHog tenant " + c.tenant + ") with " + session.Protocol + " id " + string(m.ID)
+	if len(session.To) == 1 {
+		received += "\r\n\tfor <" + session.To[0] + ">"
+	}
+	received += "; " + session.Received.Format(time.RFC1123Z)
+	returnPath := "<" + session.From + ">"
+
+	unfolded := strings.Replace(received, "\r\n\t", " ", -1)
+	m.Content.Headers["Received"] = append([]string{unfolded}, m.Content.Headers["Received"]...)
+	// a Return-Path supplied by the client is replaced
+	for k := range m.Content.Headers {
+		if strings.EqualFold(k, "Return-Path") {
+			delete(m.Content.Headers, k)
+		}
+	}
+	m.Content.Headers["Return-Path"] = []string{returnPath}
+	m.Raw.Data = "Return-Path: " + returnPath + "\r\nReceived: " + received + "\r\n" + removeHeader(m.Raw.Data, "Return-Path")
+	return session
+}
+
+// forward queues the release of a stored message for a forward action,
+// using the servers of the tenant which owns the rule
+func (c *Session) forward(tenant, id string, m *data.Message, f rules.Action) {
+	server, ok := c.config.OutgoingServers.Get(c.tenant, f.Server)
+	if !ok {
+		log.Printf("[SMTP] Forward rule uses unknown server %s", f.Server)
+		return
+	}
+	r := release.NewRelease(tenant, id, m, server, f.Options, c.config.Hostname)
+	if _, err := c.config.Releases.Enqueue(r); err != nil {
+		log.Printf("[SMTP] Error forwarding message %s: %s", id, err)
+	}
 }
 
 func (c *Session) logf(message string, args ...interface{}) {
@@ -140,12 +443,21 @@ func (c *Session) Read() bool {
 	c.line += text
 
 	for strings.Contains(c.line, "\r\n") {
+		state := c.proto.State
+		c.record(state, c.line[:strings.Index(c.line, "\r\n")])
 		line, reply := c.proto.Parse(c.line)
 		c.line = line
+		if state == smtp.DATA && c.proto.State != smtp.DATA && c.transcript != nil {
+			c.transcript.Data(c.dataSize)
+			c.dataSize = 0
+		}
+		if c.reply != nil {
+			reply, c.reply = c.reply, nil
+		}
 
 		if reply != nil {
 			c.Write(reply)
-			if reply.Status == 221 {
+			if reply.Status == 221 || c.disconnect {
 				io.Closer(c.conn).Close()
 				return false
 			}
@@ -155,6 +467,19 @@ func (c *Session) Read() bool {
 	return true
 }
 
+// record adds a line received from the client to the transcript, message
+// data is only counted and lines sent while authenticating are masked
+func (c *Session) record(state smtp.State, line string) {
+	if c.transcript == nil {
+		return
+	}
+	if state == smtp.DATA {
+		c.dataSize += len(line) + 2
+		return
+	}
+	c.transcript.Client(line, state >= smtp.AUTHPLAIN && state <= smtp.AUTHCRAMMD5)
+}
+
 // Write writes a reply to the underlying net.TCPConn
 func (c *Session) Write(reply *smtp.Reply) {
 	lines := reply.Lines()
@@ -163,5 +488,8 @@ func (c *Session) Write(reply *smtp.Reply) {
 		logText = strings.Replace(logText, "\r", "\\r", -1)
 		// c.logf("Sent %d bytes: '%s'", len(l), logText)
 		c.writer.Write([]byte(l))
+		if c.transcript != nil {
+			c.transcript.Server(l)
+		}
 	}
 }
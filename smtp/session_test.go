@@ -1,12 +1,18 @@
 package smtp
 
 import (
+	"encoding/base64"
 	"errors"
 	"sync"
 	"testing"
 
 	. "github.com/smartystreets/goconvey/convey"
 
+	"github.com/jay-dee7/MailHog-Server/config"
+	"github.com/jay-dee7/MailHog-Server/rules"
+	"github.com/jay-dee7/MailHog-Server/scenario"
+	"github.com/jay-dee7/MailHog-Server/transcript"
+	"github.com/jay-dee7/smtp"
 	"github.com/mailhog/data"
 )
 
@@ -40,7 +46,7 @@ func TestAccept(t *testing.T) {
 		frw := &fakeRw{}
 		mChan := make(chan *data.Message)
 		/// @TODO create in-memorry multi tenant storage and use it here
-		Accept("1.1.1.1:11111", frw, nil, mChan, "localhost", nil, "test")
+		Accept("1.1.1.1:11111", frw, &config.Config{Hostname: "localhost", MessageChan: mChan}, "test")
 	})
 }
 
@@ -53,7 +59,7 @@ func TestSocketError(t *testing.T) {
 		}
 		mChan := make(chan *data.Message)
 		/// @TODO create in-memorry multi tenant storage and use it here
-		Accept("1.1.1.1:11111", frw, nil, mChan, "localhost", nil, "test")
+		Accept("1.1.1.1:11111", frw, &config.Config{Hostname: "localhost", MessageChan: mChan}, "test")
 	})
 }
 
@@ -100,7 +106,7 @@ func TestAcceptMessage(t *testing.T) {
 			wg.Done()
 		}()
 		/// @TODO create in-memorry multi tenant storage and use it here
-		Accept("1.1.1.1:11111", frw, nil, mChan, "localhost", nil, "test")
+		Accept("1.1.1.1:11111", frw, &config.Config{Hostname: "localhost", MessageChan: mChan}, "test")
 		wg.Wait()
 		So(handlerCalled, ShouldBeTrue)
 	})
@@ -141,3 +147,96 @@ func TestValidateSender(t *testing.T) {
 		So(c.validateSender("foo@bar.mailhog"), ShouldBeTrue)
 	})
 }
+
+func TestRejectRule(t *testing.T) {
+	Convey("Reject rules should replace the reply to DATA", t, func() {
+		e, _ := rules.NewEngine("")
+		e.Put("test", rules.Rule{Name: "reject", Actions: []rules.Action{{Type: rules.Reject, Code: 451, Message: "Try later"}}})
+		c := &Session{proto: smtp.NewProtocol(), config: &config.Config{Rules: e}, tenant: "test"}
+
+		_, err := c.acceptMessage(&data.SMTPMessage{From: "a@mailhog.example", To: []string{"b@mailhog.example"}, Data: "Subject: Hi\r\n\r\nHi.\r\n"})
+		So(err, ShouldNotBeNil)
+		So(c.reply.Status, ShouldEqual, 451)
+		So(c.reply.Lines(), ShouldResemble, []string{"451 Try later\r\n"})
+	})
+}
+
+func TestTrace(t *testing.T) {
+	Convey("trace should add Received and Return-Path headers", t, func() {
+		c := &Session{proto: smtp.NewProtocol(), config: &config.Config{Hostname: "mailhog.example"}, tenant: "test", remoteAddress: "192.0.2.1:4321"}
+		So(c.verbFilter("EHLO"), ShouldBeNil)
+		c.validateAuthentication("PLAIN", "alice", "secret")
+
+		m := (&data.SMTPMessage{Helo: "client.example", From: "a@mailhog.example", To: []string{"b@mailhog.example"}, Data: "Subject: Hi\r\n\r\nHi.\r\n"}).Parse("mailhog.example")
+		s := c.trace(m)
+		So(s.Protocol, ShouldEqual, "ESMTPA")
+		So(s.AuthUser, ShouldEqual, "alice")
+		So(m.Content.Headers["Return-Path"], ShouldResemble, []string{"<a@mailhog.example>"})
+		So(m.Content.Headers["Received"][0], ShouldStartWith, "from client.example ([192.0.2.1]) (authenticated user alice) by mailhog.example (MailHog tenant test) with ESMTPA id "+string(m.ID)+" for <b@mailhog.example>; ")
+		So(m.Raw.Data, ShouldStartWith, "Return-Path: <a@mailhog.example>\r\nReceived: from client.example ([192.0.2.1])\r\n\t(authenticated user alice)\r\n")
+	})
+
+	Convey("trace should strip control characters and replace the client's Return-Path", t, func() {
+		c := &Session{proto: smtp.NewProtocol(), config: &config.Config{Hostname: "mailhog.example"}, tenant: "test", remoteAddress: "192.0.2.1:4321"}
+		So(c.verbFilter("EHLO"), ShouldBeNil)
+		c.validateAuthentication("LOGIN", base64.StdEncoding.EncodeToString([]byte("alice)\r\nX-Injected: yes")))
+
+		m := (&data.SMTPMessage{Helo: "client.example", From: "a@mailhog.example", To: []string{"b@mailhog.example"}, Data: "Return-Path: <spoofed@mailhog.example>\r\n\t(folded)\r\nSubject: Hi\r\n\r\nReturn-Path: body\r\n"}).Parse("mailhog.example")
+		c.trace(m)
+		So(m.Content.Headers["Received"][0], ShouldContainSubstring, "(authenticated user alice)X-Injected: yes)")
+		So(m.Content.Headers["Return-Path"], ShouldResemble, []string{"<a@mailhog.example>"})
+		So(m.Raw.Data, ShouldNotContainSubstring, "spoofed")
+		So(m.Raw.Data, ShouldNotContainSubstring, "folded")
+		So(m.Raw.Data, ShouldEndWith, "\r\nSubject: Hi\r\n\r\nReturn-Path: body\r\n")
+	})
+}
+
+func TestTranscript(t *testing.T) {
+	Convey("Sessions should be recorded with AUTH secrets masked", t, func() {
+		mbuf := "EHLO localhost\r\nAUTH PLAIN AGFsaWNlAHNlY3JldA==\r\nQUIT\r\n"
+		frw := &fakeRw{
+			_read: func(p []byte) (n int, err error) {
+				n = copy(p, mbuf)
+				mbuf = mbuf[n:]
+				return n, nil
+			},
+		}
+		ts := transcript.NewStore(10)
+		Accept("1.1.1.1:11111", frw, &config.Config{Hostname: "localhost", Transcripts: ts}, "test")
+
+		list := ts.List("test", true)
+		So(list, ShouldHaveLength, 1)
+		tr, _ := ts.Get("test", list[0].ID)
+		var lines []string
+		for _, e := range tr.Entries {
+			lines = append(lines, e.Direction+" "+e.Line)
+		}
+		So(lines[0], ShouldStartWith, "S 220 localhost")
+		So(lines, ShouldContain, "C AUTH PLAIN ***")
+		So(lines[len(lines)-1], ShouldEqual, "S 221 Bye")
+	})
+}
+
+func TestScenario(t *testing.T) {
+	Convey("Scenarios should replace the reply to RCPT and close the connection", t, func() {
+		mbuf := "EHLO localhost\r\nMAIL FROM:<a@mailhog.example>\r\nRCPT TO:<b@mailhog.example>\r\nRCPT TO:<c@mailhog.example>\r\nQUIT\r\n"
+		var rbuf []byte
+		frw := &fakeRw{
+			_read: func(p []byte) (n int, err error) {
+				n = copy(p, mbuf)
+				mbuf = mbuf[n:]
+				return n, nil
+			},
+			_write: func(p []byte) (n int, err error) {
+				rbuf = append(rbuf, p...)
+				return len(p), nil
+			},
+		}
+		s := scenario.NewStore()
+		s.Put("test", scenario.Scenario{Name: "s", Steps: []scenario.Step{{Stage: scenario.Rcpt, Nth: 2, Code: 421, Message: "4.3.2 Shutting down", Disconnect: true}}})
+		Accept("1.1.1.1:11111", frw, &config.Config{Hostname: "localhost", Scenarios: s}, "test")
+
+		So(string(rbuf), ShouldContainSubstring, "250 Recipient b@mailhog.example ok\r\n")
+		So(string(rbuf), ShouldEndWith, "421 4.3.2 Shutting down\r\n")
+	})
+}
@@ -23,8 +23,13 @@ func Listen(cfg *config.Config) *net.TCPListener {
 			continue
 		}
 
-		if cfg.Monkey != nil {
-			ok := cfg.Monkey.Accept(conn)
+		tenant := "tenant"
+		monkey := cfg.Monkey
+		if cfg.Chaos != nil {
+			monkey = cfg.Chaos.Monkey(tenant)
+		}
+		if monkey != nil {
+			ok := monkey.Accept(conn)
 			if !ok {
 				conn.Close()
 				continue
@@ -34,11 +39,8 @@ func Listen(cfg *config.Config) *net.TCPListener {
 		go Accept(
 			conn.(*net.TCPConn).RemoteAddr().String(),
 			io.ReadWriteCloser(conn),
-			cfg.Storage,
-			cfg.MessageChan,
-			cfg.Hostname,
-			cfg.Monkey,
-			"tenant",
+			cfg,
+			tenant,
 		)
 	}
 }
@@ -0,0 +1,187 @@
+// Package threading groups messages into conversations using their
+// Message-ID, In-Reply-To and References headers and their subjects.
+package threading
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jay-dee7/MailHog-Server/mimetree"
+	"github.com/mailhog/data"
+)
+
+// Thread summarises a conversation
+type Thread struct {
+	// ID is the MailHog ID of the first message of the thread
+	ID           string    `json:"id"`
+	Subject      string    `json:"subject"`
+	Participants []string  `json:"participants"`
+	MessageCount int       `json:"messageCount"`
+	First        time.Time `json:"first"`
+	Last         time.Time `json:"last"`
+	// MessageIDs are the MailHog IDs of the messages, oldest first
+	MessageIDs []string `json:"messageIds"`
+}
+
+var (
+	msgIDRegexp = regexp.MustCompile(`<[^<>]+>`)
+	// reply and forward prefixes, including common translations and counters
+	// such as Re[2]:, and mailing list tags such as [list]
+	subjectPrefixRegexp = regexp.MustCompile(`(?i)^\s*((re|fw|fwd|aw|wg|sv|vs|antw)(\[\d+\])?\s*:|\[[^\]]*\])\s*`)
+	// a reply or forward prefix, possibly after mailing list tags
+	replyRegexp = regexp.MustCompile(`(?i)^\s*(\[[^\]]*\]\s*)*(re|fw|fwd|aw|wg|sv|vs|antw)(\[\d+\])?\s*:`)
+)
+
+// isReply returns true if a subject starts with a reply or forward prefix
+func isReply(subject string) bool {
+	return replyRegexp.MatchString(subject)
+}
+
+// NormalizeSubject strips reply and forward prefixes and mailing list tags
+// from a subject, and normalizes its case and whitespace
+func NormalizeSubject(subject string) string {
+	for {
+		s := subjectPrefixRegexp.ReplaceAllString(subject, "")
+		if s == subject {
+			break
+		}
+		subject = s
+	}
+	return strings.ToLower(strings.Join(strings.Fields(subject), " "))
+}
+
+// messageIDs returns the message IDs in header values, without brackets
+func messageIDs(values []string) []string {
+	var ids []string
+	for _, v := range values {
+		for _, id := range msgIDRegexp.FindAllString(v, -1) {
+			ids = append(ids, strings.Trim(id, "<>"))
+		}
+	}
+	return ids
+}
+
+// unionFind joins the keys of messages which belong to the same thread
+type unionFind map[string]string
+
+func (u unionFind) find(k string) string {
+	if _, ok := u[k]; !ok {
+		u[k] = k
+	}
+	for u[k] != k {
+		u[k] = u[u[k]]
+		k = u[k]
+	}
+	return k
+}
+
+func (u unionFind) union(a, b string) {
+	if ra, rb := u.find(a), u.find(b); ra != rb {
+		u[ra] = rb
+	}
+}
+
+// Build groups messages into threads, most recently active first. Messages
+// are linked through the Message-IDs they reference. A reply without
+// In-Reply-To or References headers joins the latest earlier message with
+// the same normalized subject, so unrelated messages which merely share a
+// subject stay apart.
+func Build(messages []data.Message) []Thread {
+	u := make(unionFind)
+	var orphans []*data.Message
+	bySubject := make(map[string][]*data.Message)
+	for i := range messages {
+		m := &messages[i]
+		key := "mailhog:" + string(m.ID)
+		u.find(key)
+
+		refs := messageIDs(mimetree.Header(m, "In-Reply-To"))
+		refs = append(refs, messageIDs(mimetree.Header(m, "References"))...)
+		for _, id := range append(messageIDs(mimetree.Header(m, "Message-ID")), refs...) {
+			u.union(key, "id:"+id)
+		}
+		if len(refs) > 0 {
+			continue
+		}
+
+		subject := first(mimetree.Header(m, "Subject"))
+		if isReply(subject) {
+			orphans = append(orphans, m)
+		} else if s := NormalizeSubject(subject); len(s) > 0 {
+			bySubject[s] = append(bySubject[s], m)
+		}
+	}
+
+	for _, m := range orphans {
+		subject := NormalizeSubject(first(mimetree.Header(m, "Subject")))
+		if len(subject) == 0 {
+			continue
+		}
+		var parent *data.Message
+		for _, p := range bySubject[subject] {
+			if !p.Created.After(m.Created) && (parent == nil || p.Created.After(parent.Created)) {
+				parent = p
+			}
+		}
+		if parent != nil {
+			u.union("mailhog:"+string(m.ID), "mailhog:"+string(parent.ID))
+		} else {
+			u.union("mailhog:"+string(m.ID), "subject:"+subject)
+		}
+	}
+
+	groups := make(map[string][]data.Message)
+	for _, m := range messages {
+		root := u.find("mailhog:" + string(m.ID))
+		groups[root] = append(groups[root], m)
+	}
+
+	threads := make([]Thread, 0, len(groups))
+	for _, group := range groups {
+		threads = append(threads, summarise(group))
+	}
+	sort.Slice(threads, func(i, j int) bool {
+		if !threads[i].Last.Equal(threads[j].Last) {
+			return threads[i].Last.After(threads[j].Last)
+		}
+		return threads[i].ID < threads[j].ID
+	})
+	return threads
+}
+
+func summarise(messages []data.Message) Thread {
+	sort.SliceStable(messages, func(i, j int) bool { return messages[i].Created.Before(messages[j].Created) })
+
+	t := Thread{
+		ID:           string(messages[0].ID),
+		Subject:      first(mimetree.Header(&messages[0], "Subject")),
+		MessageCount: len(messages),
+		First:        messages[0].Created,
+		Last:         messages[len(messages)-1].Created,
+	}
+
+	seen := make(map[string]bool)
+	for _, m := range messages {
+		t.MessageIDs = append(t.MessageIDs, string(m.ID))
+		for _, p := range append([]*data.Path{m.From}, m.To...) {
+			if p == nil {
+				continue
+			}
+			addr := strings.ToLower(p.Mailbox + "@" + p.Domain)
+			if !seen[addr] {
+				seen[addr] = true
+				t.Participants = append(t.Participants, addr)
+			}
+		}
+	}
+	return t
+}
+
+func first(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
@@ -0,0 +1,76 @@
+package threading
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/mailhog/data"
+)
+
+func message(id string, created time.Time, headers map[string][]string) data.Message {
+	return data.Message{
+		ID:      data.MessageID(id),
+		From:    &data.Path{Mailbox: "shop", Domain: "mailhog.example"},
+		To:      []*data.Path{{Mailbox: "customer", Domain: "mailhog.example"}},
+		Created: created,
+		Content: &data.Content{Headers: headers},
+	}
+}
+
+func TestNormalizeSubject(t *testing.T) {
+	Convey("NormalizeSubject should strip reply prefixes and list tags", t, func() {
+		So(NormalizeSubject("Re: Fwd: [shop]  Your  Order"), ShouldEqual, "your order")
+		So(NormalizeSubject("AW: Re[2]: Your order"), ShouldEqual, "your order")
+		So(NormalizeSubject("Order shipped"), ShouldEqual, "order shipped")
+	})
+}
+
+func TestBuild(t *testing.T) {
+	Convey("Build should group messages by references and subject", t, func() {
+		now := time.Now()
+		threads := Build([]data.Message{
+			message("shipped", now.Add(time.Minute), map[string][]string{
+				"Message-ID": {"<2@shop.example>"},
+				"references": {"<1@shop.example>"},
+				"Subject":    {"Your order has shipped"},
+			}),
+			message("placed", now, map[string][]string{
+				"Message-Id": {"<1@shop.example>"},
+				"Subject":    {"Order placed"},
+			}),
+			message("reply", now.Add(2*time.Minute), map[string][]string{
+				"Subject": {"RE: Order placed"},
+			}),
+			message("other", now.Add(-time.Hour), map[string][]string{
+				"Subject": {"Welcome"},
+			}),
+		})
+
+		So(threads, ShouldHaveLength, 2)
+		So(threads[0].ID, ShouldEqual, "placed")
+		So(threads[0].Subject, ShouldEqual, "Order placed")
+		So(threads[0].MessageIDs, ShouldResemble, []string{"placed", "shipped", "reply"})
+		So(threads[0].Participants, ShouldResemble, []string{"shop@mailhog.example", "customer@mailhog.example"})
+		So(threads[1].MessageCount, ShouldEqual, 1)
+	})
+
+	Convey("Build should only group replies without references by subject", t, func() {
+		now := time.Now()
+		threads := Build([]data.Message{
+			message("welcome1", now, map[string][]string{"Subject": {"Welcome!"}}),
+			message("welcome2", now.Add(time.Minute), map[string][]string{"Subject": {"Welcome!"}}),
+			message("reply", now.Add(2*time.Minute), map[string][]string{"Subject": {"Re: Welcome!"}}),
+			message("answer", now.Add(3*time.Minute), map[string][]string{
+				"Subject":     {"Re: Welcome!"},
+				"In-Reply-To": {"<1@elsewhere.example>"},
+			}),
+		})
+
+		So(threads, ShouldHaveLength, 3)
+		So(threads[0].MessageIDs, ShouldResemble, []string{"answer"})
+		So(threads[1].MessageIDs, ShouldResemble, []string{"welcome2", "reply"})
+		So(threads[2].MessageIDs, ShouldResemble, []string{"welcome1"})
+	})
+}
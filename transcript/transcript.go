@@ -0,0 +1,215 @@
+// Package transcript records bounded transcripts of SMTP sessions, with
+// authentication secrets masked, and keeps the latest ones of each tenant.
+package transcript
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limits of a transcript, longer lines are cut and further lines dropped
+const (
+	MaxEntries    = 1000
+	MaxLineLength = 512
+)
+
+// Directions of an entry
+const (
+	Client = "C"
+	Server = "S"
+)
+
+// Mask replaces authentication secrets
+const Mask = "***"
+
+// Entry is a line sent by the client or the server
+type Entry struct {
+	Time      time.Time `json:"time"`
+	Direction string    `json:"direction"`
+	Line      string    `json:"line"`
+}
+
+// Transcript is the conversation of an SMTP session
+type Transcript struct {
+	ID         string `json:"id"`
+	Tenant     string `json:"tenant"`
+	RemoteAddr string `json:"remoteAddr"`
+	// MessageIDs are the IDs of the messages stored during the session, a
+	// session without messages failed
+	MessageIDs []string  `json:"messageIds"`
+	Started    time.Time `json:"started"`
+	// Ended is zero while the session is active
+	Ended     time.Time `json:"ended,omitempty"`
+	Entries   []Entry   `json:"entries"`
+	Truncated bool      `json:"truncated"`
+
+	mu sync.Mutex
+}
+
+// Failed returns true if no message was stored during the session
+func (t *Transcript) Failed() bool {
+	return len(t.MessageIDs) == 0
+}
+
+func (t *Transcript) add(direction, line string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(t.Entries) >= MaxEntries {
+		t.Truncated = true
+		return
+	}
+	if len(line) > MaxLineLength {
+		line = line[:MaxLineLength] + "..."
+	}
+	t.Entries = append(t.Entries, Entry{Time: time.Now(), Direction: direction, Line: line})
+}
+
+// Client records a command sent by the client, masking the credentials of
+// AUTH commands. A line received while authenticating is a secret.
+func (t *Transcript) Client(line string, authenticating bool) {
+	if authenticating {
+		line = Mask
+	} else if words := strings.SplitN(line, " ", 3); len(words) == 3 && strings.EqualFold(words[0], "AUTH") {
+		line = words[0] + " " + words[1] + " " + Mask
+	}
+	t.add(Client, line)
+}
+
+// Data records message data sent by the client by its size
+func (t *Transcript) Data(size int) {
+	t.add(Client, "<message data, "+strconv.Itoa(size)+" bytes>")
+}
+
+// Server records a reply sent by the server
+func (t *Transcript) Server(line string) {
+	t.add(Server, strings.TrimRight(line, "\r\n"))
+}
+
+// Stored links a message stored during the session
+func (t *Transcript) Stored(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.MessageIDs = append(t.MessageIDs, id)
+}
+
+// End marks the session as ended
+func (t *Transcript) End() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.Ended = time.Now()
+}
+
+// copy returns a copy of the transcript, without entries unless full
+func (t *Transcript) copy(full bool) *Transcript {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	c := &Transcript{
+		ID:         t.ID,
+		Tenant:     t.Tenant,
+		RemoteAddr: t.RemoteAddr,
+		MessageIDs: append([]string{}, t.MessageIDs...),
+		Started:    t.Started,
+		Ended:      t.Ended,
+		Entries:    []Entry{},
+		Truncated:  t.Truncated,
+	}
+	if full {
+		c.Entries = append(c.Entries, t.Entries...)
+	}
+	return c
+}
+
+// Store keeps the latest transcripts of each tenant
+type Store struct {
+	mu          sync.RWMutex
+	limit       int
+	transcripts map[string][]*Transcript
+}
+
+// NewStore creates a store keeping up to limit transcripts per tenant
+func NewStore(limit int) *Store {
+	return &Store{
+		limit:       limit,
+		transcripts: make(map[string][]*Transcript),
+	}
+}
+
+// Start creates the transcript of a new session, dropping the oldest
+// transcript of the tenant if it has too many
+func (s *Store) Start(tenant, remoteAddr string) *Transcript {
+	t := &Transcript{
+		ID:         newID(),
+		Tenant:     tenant,
+		RemoteAddr: remoteAddr,
+		Started:    time.Now(),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ts := append(s.transcripts[tenant], t)
+	if len(ts) > s.limit {
+		ts = append([]*Transcript(nil), ts[len(ts)-s.limit:]...)
+	}
+	s.transcripts[tenant] = ts
+	return t
+}
+
+// List returns the transcripts of the tenant without their entries, most
+// recent first, only those of failed sessions if failed is set
+func (s *Store) List(tenant string, failed bool) []*Transcript {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	list := []*Transcript{}
+	for _, t := range s.transcripts[tenant] {
+		c := t.copy(false)
+		if !failed || (c.Failed() && !c.Ended.IsZero()) {
+			list = append(list, c)
+		}
+	}
+	sort.SliceStable(list, func(i, j int) bool { return list[i].Started.After(list[j].Started) })
+	return list
+}
+
+// Get returns a transcript of the tenant
+func (s *Store) Get(tenant, id string) (*Transcript, bool) {
+	return s.find(tenant, func(t *Transcript) bool { return t.ID == id })
+}
+
+// ForMessage returns the transcript of the session a message was stored in
+func (s *Store) ForMessage(tenant, messageID string) (*Transcript, bool) {
+	return s.find(tenant, func(t *Transcript) bool {
+		for _, id := range t.MessageIDs {
+			if id == messageID {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func (s *Store) find(tenant string, match func(*Transcript) bool) (*Transcript, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, t := range s.transcripts[tenant] {
+		if match(t.copy(false)) {
+			return t.copy(true), true
+		}
+	}
+	return nil, false
+}
+
+func newID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,57 @@
+package transcript
+
+import (
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestTranscript(t *testing.T) {
+	Convey("Transcripts should mask secrets and be bounded", t, func() {
+		s := NewStore(2)
+		tr := s.Start("a", "192.0.2.1:25")
+		tr.Server("220 mailhog.example ESMTP MailHog\r\n")
+		tr.Client("AUTH PLAIN AGFsaWNlAHNlY3JldA==", false)
+		tr.Client("c2VjcmV0", true)
+		tr.Client(strings.Repeat("x", MaxLineLength+1), false)
+
+		got, ok := s.Get("a", tr.ID)
+		So(ok, ShouldBeTrue)
+		So(got.Entries[0].Line, ShouldEqual, "220 mailhog.example ESMTP MailHog")
+		So(got.Entries[1].Line, ShouldEqual, "AUTH PLAIN "+Mask)
+		So(got.Entries[2].Line, ShouldEqual, Mask)
+		So(got.Entries[3].Line, ShouldHaveLength, MaxLineLength+3)
+
+		for i := 0; i < MaxEntries; i++ {
+			tr.Client("NOOP", false)
+		}
+		got, _ = s.Get("a", tr.ID)
+		So(got.Entries, ShouldHaveLength, MaxEntries)
+		So(got.Truncated, ShouldBeTrue)
+	})
+
+	Convey("The store should keep the latest transcripts and link messages", t, func() {
+		s := NewStore(2)
+		first := s.Start("a", "192.0.2.1:25")
+		first.End()
+		second := s.Start("a", "192.0.2.1:25")
+		second.Stored("m1")
+		second.End()
+		third := s.Start("a", "192.0.2.1:25")
+		third.End()
+
+		_, ok := s.Get("a", first.ID)
+		So(ok, ShouldBeFalse)
+		So(s.List("a", false), ShouldHaveLength, 2)
+
+		failed := s.List("a", true)
+		So(failed, ShouldHaveLength, 1)
+		So(failed[0].ID, ShouldEqual, third.ID)
+
+		got, ok := s.ForMessage("a", "m1")
+		So(ok, ShouldBeTrue)
+		So(got.ID, ShouldEqual, second.ID)
+		So(s.List("b", false), ShouldBeEmpty)
+	})
+}
@@ -0,0 +1,353 @@
+// Package webhooks notifies subscribed HTTP endpoints of message events.
+package webhooks
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jay-dee7/MailHog-Server/mimetree"
+	"github.com/jay-dee7/MailHog-Server/release"
+	"github.com/mailhog/data"
+)
+
+// Event types
+const (
+	Stored   = "stored"
+	Deleted  = "deleted"
+	Released = "released"
+)
+
+// ErrInvalidWebhook is returned for a webhook without a name or a valid URL
+var ErrInvalidWebhook = errors.New("webhook requires a name and an http or https url")
+
+// ErrInvalidEvent is returned for an unknown event type
+var ErrInvalidEvent = errors.New("invalid event type")
+
+// ErrWebhookNotFound is returned for an unknown webhook
+var ErrWebhookNotFound = errors.New("webhook not found")
+
+// Webhook is a subscription of an HTTP endpoint to events of a tenant
+type Webhook struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+	// Events are the event types to notify, every type if empty
+	Events []string `json:"events,omitempty"`
+	// Filter is a regular expression matched against the sender, recipients
+	// and subject of the message. Events without a message always match.
+	Filter string `json:"filter,omitempty"`
+	// Secret signs the requests with HMAC-SHA256 if set
+	Secret string `json:"secret,omitempty"`
+
+	filter *regexp.Regexp
+}
+
+func (h *Webhook) compile() error {
+	u, err := url.Parse(h.URL)
+	if len(h.Name) == 0 || err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return ErrInvalidWebhook
+	}
+	for _, e := range h.Events {
+		switch e {
+		case Stored, Deleted, Released:
+		default:
+			return ErrInvalidEvent
+		}
+	}
+
+	h.filter = nil
+	if len(h.Filter) > 0 {
+		if h.filter, err = regexp.Compile(h.Filter); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Redacted returns a copy of the webhook without its secret
+func (h Webhook) Redacted() Webhook {
+	h.Secret = ""
+	return h
+}
+
+func (h *Webhook) match(e *Event) bool {
+	if len(h.Events) > 0 {
+		found := false
+		for _, t := range h.Events {
+			if t == e.Type {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if h.filter == nil || e.Message == nil {
+		return true
+	}
+	for _, s := range messageFields(e.Message) {
+		if h.filter.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// messageFields returns the sender, recipients and subject of a message
+func messageFields(m *data.Message) []string {
+	var fields []string
+	if m.Raw != nil {
+		fields = append(fields, m.Raw.From)
+		fields = append(fields, m.Raw.To...)
+	} else {
+		if m.From != nil {
+			fields = append(fields, m.From.Mailbox+"@"+m.From.Domain)
+		}
+		for _, p := range m.To {
+			fields = append(fields, p.Mailbox+"@"+p.Domain)
+		}
+	}
+	return append(fields, mimetree.Header(m, "Subject")...)
+}
+
+// Event is the body posted to webhooks
+type Event struct {
+	ID        string           `json:"id"`
+	Type      string           `json:"type"`
+	Tenant    string           `json:"tenant"`
+	MessageID string           `json:"messageId,omitempty"`
+	Message   *data.Message    `json:"message,omitempty"`
+	Release   *release.Release `json:"release,omitempty"`
+	Created   time.Time        `json:"created"`
+}
+
+// Sign returns the signature of a request body, sent in the
+// X-MailHog-Signature header
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Dispatcher holds the webhooks of each tenant and delivers events to them
+// in the background, retrying failed deliveries with an exponential backoff
+type Dispatcher struct {
+	// MaxAttempts is the number of delivery attempts before an event is dropped
+	MaxAttempts int
+	// Backoff is the delay before the first retry, doubled for each retry
+	Backoff time.Duration
+	Client  *http.Client
+
+	mu       sync.RWMutex
+	path     string
+	cipher   *release.Cipher
+	webhooks map[string]map[string]*Webhook
+}
+
+// NewDispatcher creates a dispatcher, loading the webhooks saved to path.
+// An empty path keeps the webhooks in memory only. Secrets are encrypted
+// in the file if cipher isn't nil.
+func NewDispatcher(path string, cipher *release.Cipher) (*Dispatcher, error) {
+	d := &Dispatcher{
+		MaxAttempts: 5,
+		Backoff:     10 * time.Second,
+		Client:      &http.Client{Timeout: 10 * time.Second},
+		path:        path,
+		cipher:      cipher,
+		webhooks:    make(map[string]map[string]*Webhook),
+	}
+	if len(path) == 0 {
+		return d, nil
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return d, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &d.webhooks); err != nil {
+		return nil, err
+	}
+	for _, webhooks := range d.webhooks {
+		for name, h := range webhooks {
+			h.Name = name
+			if h.Secret, err = cipher.Open(h.Secret); err != nil {
+				return nil, err
+			}
+			if err := h.compile(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return d, nil
+}
+
+// List returns the webhooks of the tenant, sorted by name
+func (d *Dispatcher) List(tenant string) []Webhook {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	webhooks := []Webhook{}
+	for _, h := range d.webhooks[tenant] {
+		webhooks = append(webhooks, *h)
+	}
+	sort.Slice(webhooks, func(i, j int) bool { return webhooks[i].Name < webhooks[j].Name })
+	return webhooks
+}
+
+// Get returns the named webhook of the tenant
+func (d *Dispatcher) Get(tenant, name string) (Webhook, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	h, ok := d.webhooks[tenant][name]
+	if !ok {
+		return Webhook{}, false
+	}
+	return *h, true
+}
+
+// Put validates and adds or replaces a webhook of the tenant
+func (d *Dispatcher) Put(tenant string, h Webhook) error {
+	if err := h.compile(); err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.webhooks[tenant]; !ok {
+		d.webhooks[tenant] = make(map[string]*Webhook)
+	}
+	d.webhooks[tenant][h.Name] = &h
+	return d.save()
+}
+
+// Delete removes a webhook of the tenant
+func (d *Dispatcher) Delete(tenant, name string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.webhooks[tenant][name]; !ok {
+		return ErrWebhookNotFound
+	}
+	delete(d.webhooks[tenant], name)
+	return d.save()
+}
+
+// Notify delivers an event to the matching webhooks of its tenant in the
+// background
+func (d *Dispatcher) Notify(e Event) {
+	e.ID = newID()
+	e.Created = time.Now()
+
+	var webhooks []Webhook
+	for _, h := range d.List(e.Tenant) {
+		if h.match(&e) {
+			webhooks = append(webhooks, h)
+		}
+	}
+	if len(webhooks) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("[WEBHOOK] Error encoding %s event: %s", e.Type, err)
+		return
+	}
+	for _, h := range webhooks {
+		go d.deliver(h, e, body)
+	}
+}
+
+func (d *Dispatcher) deliver(h Webhook, e Event, body []byte) {
+	for attempt := 1; ; attempt++ {
+		err := d.post(h, e, body)
+		if err == nil {
+			return
+		}
+		if attempt >= d.MaxAttempts {
+			log.Printf("[WEBHOOK] Failed to deliver %s event to %s: %s", e.Type, h.Name, err)
+			return
+		}
+		log.Printf("[WEBHOOK] Failed to deliver %s event to %s, retrying: %s", e.Type, h.Name, err)
+		time.Sleep(d.Backoff << uint(attempt-1))
+	}
+}
+
+func (d *Dispatcher) post(h Webhook, e Event, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-MailHog-Event", e.Type)
+	req.Header.Set("X-MailHog-Delivery", e.ID)
+	if len(h.Secret) > 0 {
+		req.Header.Set("X-MailHog-Signature", Sign(h.Secret, body))
+	}
+
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// save persists the webhooks, the caller must hold d.mu
+func (d *Dispatcher) save() error {
+	if len(d.path) == 0 {
+		return nil
+	}
+
+	webhooks := make(map[string]map[string]Webhook)
+	for tenant, hooks := range d.webhooks {
+		webhooks[tenant] = make(map[string]Webhook)
+		for name, h := range hooks {
+			c := *h
+			c.Secret = d.cipher.Seal(h.Secret)
+			webhooks[tenant][name] = c
+		}
+	}
+
+	b, err := json.MarshalIndent(webhooks, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := d.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, d.path)
+}
+
+func newID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
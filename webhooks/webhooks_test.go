@@ -0,0 +1,86 @@
+package webhooks
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/mailhog/data"
+)
+
+type request struct {
+	header http.Header
+	body   []byte
+}
+
+// standIn records the requests it receives, failing the first `fail` of them
+func standIn(fail int) (*httptest.Server, chan request) {
+	requests := make(chan request, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		if fail > 0 {
+			fail--
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		requests <- request{r.Header, b}
+	}))
+	return srv, requests
+}
+
+func receive(requests chan request) *request {
+	select {
+	case r := <-requests:
+		return &r
+	case <-time.After(2 * time.Second):
+		return nil
+	}
+}
+
+func TestNotify(t *testing.T) {
+	Convey("Events should be signed and retried until delivered", t, func() {
+		srv, requests := standIn(2)
+		defer srv.Close()
+
+		d, _ := NewDispatcher("", nil)
+		d.Backoff = time.Millisecond
+		So(d.Put("a", Webhook{Name: "ci", URL: srv.URL, Secret: "s3cret"}), ShouldBeNil)
+
+		d.Notify(Event{Type: Stored, Tenant: "a", MessageID: "m"})
+		r := receive(requests)
+		So(r, ShouldNotBeNil)
+		So(r.header.Get("X-MailHog-Event"), ShouldEqual, Stored)
+		So(r.header.Get("X-MailHog-Signature"), ShouldEqual, Sign("s3cret", r.body))
+	})
+
+	Convey("Events should only be delivered to matching webhooks", t, func() {
+		srv, requests := standIn(0)
+		defer srv.Close()
+
+		d, _ := NewDispatcher("", nil)
+		So(d.Put("a", Webhook{Name: "ci", URL: srv.URL, Events: []string{Stored}, Filter: `@ci\.example$`}), ShouldBeNil)
+
+		other := &data.Message{Raw: &data.SMTPMessage{From: "a@mailhog.example", To: []string{"b@mailhog.example"}}}
+		d.Notify(Event{Type: Stored, Tenant: "a", Message: other})
+		d.Notify(Event{Type: Deleted, Tenant: "a"})
+		d.Notify(Event{Type: Stored, Tenant: "b"})
+
+		ci := &data.Message{Raw: &data.SMTPMessage{From: "a@mailhog.example", To: []string{"build@ci.example"}}}
+		d.Notify(Event{Type: Stored, Tenant: "a", MessageID: "ci", Message: ci})
+
+		r := receive(requests)
+		So(r, ShouldNotBeNil)
+		So(string(r.body), ShouldContainSubstring, `"messageId":"ci"`)
+		So(len(requests), ShouldEqual, 0)
+	})
+
+	Convey("Put should reject invalid webhooks", t, func() {
+		d, _ := NewDispatcher("", nil)
+		So(d.Put("a", Webhook{Name: "ci", URL: "ftp://ci.example"}), ShouldEqual, ErrInvalidWebhook)
+		So(d.Put("a", Webhook{Name: "ci", URL: "http://ci.example", Events: []string{"OINK"}}), ShouldEqual, ErrInvalidEvent)
+	})
+}